@@ -0,0 +1,28 @@
+// bakes the commit and build date into the binary for `aiterm --version`;
+// release builds can set AITERM_COMMIT / AITERM_BUILD_DATE explicitly
+use std::env;
+use std::process::Command;
+
+fn main() {
+    let commit = env::var("AITERM_COMMIT")
+        .ok()
+        .or_else(|| output("git", &["rev-parse", "--short", "HEAD"]))
+        .unwrap_or_else(|| "unknown".to_string());
+    let build_date = env::var("AITERM_BUILD_DATE")
+        .ok()
+        .or_else(|| output("date", &["-u", "+%Y-%m-%d"]))
+        .unwrap_or_else(|| "unknown".to_string());
+
+    println!("cargo:rustc-env=AITERM_COMMIT={}", commit);
+    println!("cargo:rustc-env=AITERM_BUILD_DATE={}", build_date);
+    println!("cargo:rerun-if-env-changed=AITERM_COMMIT");
+    println!("cargo:rerun-if-env-changed=AITERM_BUILD_DATE");
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs");
+}
+
+fn output(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+    let text = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    (output.status.success() && !text.is_empty()).then_some(text)
+}
@@ -0,0 +1,97 @@
+// named snapshots of the history file, kept next to it in branches/
+use crate::history;
+use anyhow::{Context, Result, anyhow};
+use chrono::{DateTime, Local};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+pub const MAX_BRANCHES: usize = 10;
+
+pub struct Branch {
+    pub name: String,
+    pub created: DateTime<Local>,
+    pub turns: usize,
+}
+
+fn branch_dir(history_path: &Path) -> PathBuf {
+    history_path.with_file_name("branches")
+}
+
+// names become file names, so keep them boring
+fn branch_path(history_path: &Path, name: &str) -> Result<PathBuf> {
+    let valid = !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+        && !name.starts_with('.');
+    if !valid {
+        return Err(anyhow!(
+            "Invalid branch name {:?}: use letters, digits, '-', '_' and '.'",
+            name
+        ));
+    }
+    Ok(branch_dir(history_path).join(format!("{}.jsonl", name)))
+}
+
+// snapshots the current history; returns the branch dropped to stay under
+// MAX_BRANCHES, if any
+pub fn create(history_path: &Path, name: &str) -> Result<Option<String>> {
+    let path = branch_path(history_path, name)?;
+    let dir = branch_dir(history_path);
+    fs::create_dir_all(&dir).with_context(|| format!("Failed to create branch dir: {:?}", dir))?;
+
+    let mut dropped = None;
+    let branches = list(history_path)?;
+    if branches.len() >= MAX_BRANCHES && !path.exists() {
+        // list() is oldest first
+        let oldest = &branches[0];
+        fs::remove_file(branch_path(history_path, &oldest.name)?)
+            .with_context(|| format!("Failed to remove branch {:?}", oldest.name))?;
+        dropped = Some(oldest.name.clone());
+    }
+
+    let entries = history::load(history_path)?;
+    let _ = fs::remove_file(&path);
+    history::append(&path, &entries)?;
+    Ok(dropped)
+}
+
+// replaces the current history with the snapshot
+pub fn checkout(history_path: &Path, name: &str) -> Result<()> {
+    let path = branch_path(history_path, name)?;
+    if !path.exists() {
+        return Err(anyhow!("No branch named {:?}", name));
+    }
+    fs::copy(&path, history_path)
+        .with_context(|| format!("Failed to restore branch {:?}", name))?;
+    Ok(())
+}
+
+pub fn list(history_path: &Path) -> Result<Vec<Branch>> {
+    let dir = branch_dir(history_path);
+    if !dir.exists() {
+        return Ok(vec![]);
+    }
+    let mut branches = Vec::new();
+    for entry in fs::read_dir(&dir).with_context(|| format!("Failed to read {:?}", dir))? {
+        let path = entry?.path();
+        if path.extension().and_then(|ext| ext.to_str()) != Some("jsonl") {
+            continue;
+        }
+        let Some(name) = path.file_stem().and_then(|s| s.to_str()) else {
+            continue;
+        };
+        let created = fs::metadata(&path)?.modified()?.into();
+        let turns = history::load(&path)?
+            .iter()
+            .filter(|e| e.role == "user")
+            .count();
+        branches.push(Branch {
+            name: name.to_string(),
+            created,
+            turns,
+        });
+    }
+    branches.sort_by_key(|b| b.created);
+    Ok(branches)
+}
@@ -0,0 +1,185 @@
+// the same prompt sent to several models at once
+use crate::vendors::{LanguageModel, Message, TokenUsage};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+pub struct CompareResult {
+    pub model: String,
+    pub response: Result<String, String>,
+    pub latency: Duration,
+    pub usage: Option<TokenUsage>,
+}
+
+// results come back in the order the models were given, one per model: a
+// model that errors, runs past `timeout` or panics gets an Err row instead of
+// holding up or dropping the others
+pub async fn run(
+    messages: Vec<Message>,
+    models: Vec<(String, Box<dyn LanguageModel>)>,
+    timeout: Duration,
+) -> Vec<CompareResult> {
+    let messages = Arc::new(messages);
+    let started = Instant::now();
+    let tasks: Vec<_> = models
+        .into_iter()
+        .map(|(name, model)| {
+            let messages = messages.clone();
+            let task = tokio::spawn(async move {
+                let started = Instant::now();
+                let response = match tokio::time::timeout(timeout, model.ask(&messages)).await {
+                    Ok(response) => response.map_err(|e| e.to_string()),
+                    Err(_) => Err(format!("Request timed out after {}s", timeout.as_secs())),
+                };
+                (response, started.elapsed(), model.last_usage())
+            });
+            (name, task)
+        })
+        .collect();
+
+    let mut results = Vec::new();
+    for (name, task) in tasks {
+        let (response, latency, usage) = match task.await {
+            Ok(finished) => finished,
+            Err(e) => (
+                Err(format!("the request panicked: {}", e)),
+                started.elapsed(),
+                None,
+            ),
+        };
+        results.push(CompareResult {
+            model: name,
+            response,
+            latency,
+            usage,
+        });
+    }
+    results
+}
+
+pub fn header(result: &CompareResult) -> String {
+    let mut header = format!("{} ({:.1}s", result.model, result.latency.as_secs_f64());
+    if let Some(usage) = result.usage {
+        header.push_str(&format!(", {} tokens", usage.total()));
+    }
+    header.push(')');
+    header
+}
+
+pub fn body(result: &CompareResult) -> String {
+    match &result.response {
+        Ok(response) => response.trim().to_string(),
+        Err(e) => format!("Error: {}", e),
+    }
+}
+
+// one column per model, each wrapped to fit the terminal
+pub fn side_by_side(results: &[CompareResult], width: usize) -> String {
+    let gap = " │ ";
+    let columns = results.len().max(1);
+    let column_width = (width.saturating_sub(gap.len() * (columns - 1)) / columns).max(10);
+
+    let wrapped: Vec<Vec<String>> = results
+        .iter()
+        .map(|result| {
+            let mut lines = wrap_lines(&header(result), column_width);
+            lines.push("─".repeat(column_width));
+            lines.extend(wrap_lines(&body(result), column_width));
+            lines
+        })
+        .collect();
+    let height = wrapped.iter().map(Vec::len).max().unwrap_or(0);
+
+    let mut out = String::new();
+    for row in 0..height {
+        let cells: Vec<String> = wrapped
+            .iter()
+            .map(|lines| {
+                let cell = lines.get(row).map(String::as_str).unwrap_or("");
+                let pad = column_width.saturating_sub(cell.chars().count());
+                format!("{}{}", cell, " ".repeat(pad))
+            })
+            .collect();
+        out.push_str(cells.join(gap).trim_end());
+        out.push('\n');
+    }
+    out
+}
+
+// hard-wraps each line at `width` characters, keeping blank lines
+fn wrap_lines(text: &str, width: usize) -> Vec<String> {
+    let mut lines = Vec::new();
+    for line in text.lines() {
+        let chars: Vec<char> = line.chars().collect();
+        if chars.is_empty() {
+            lines.push(String::new());
+        }
+        for piece in chars.chunks(width) {
+            lines.push(piece.iter().collect());
+        }
+    }
+    lines
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vendors::ResponseStream;
+    use async_trait::async_trait;
+
+    enum Fake {
+        Answer(&'static str),
+        Hang,
+        Panic,
+    }
+
+    #[async_trait]
+    impl LanguageModel for Fake {
+        async fn ask(
+            &self,
+            _messages: &[Message],
+        ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+            match self {
+                Fake::Answer(text) => Ok(text.to_string()),
+                Fake::Hang => {
+                    tokio::time::sleep(Duration::from_secs(60)).await;
+                    Ok("too late".to_string())
+                }
+                Fake::Panic => panic!("vendor bug"),
+            }
+        }
+
+        async fn ask_stream(
+            &self,
+            _messages: &[Message],
+        ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+            unimplemented!()
+        }
+    }
+
+    #[tokio::test]
+    async fn one_row_per_model() {
+        let models: Vec<(String, Box<dyn LanguageModel>)> = vec![
+            ("slow".to_string(), Box::new(Fake::Hang)),
+            ("a".to_string(), Box::new(Fake::Answer("one"))),
+            ("broken".to_string(), Box::new(Fake::Panic)),
+            ("b".to_string(), Box::new(Fake::Answer("two"))),
+        ];
+        let results = run(Vec::new(), models, Duration::from_millis(50)).await;
+
+        let names: Vec<&str> = results.iter().map(|r| r.model.as_str()).collect();
+        assert_eq!(names, ["slow", "a", "broken", "b"]);
+        assert_eq!(
+            results[0].response,
+            Err("Request timed out after 0s".to_string())
+        );
+        assert_eq!(results[1].response, Ok("one".to_string()));
+        assert!(
+            results[2]
+                .response
+                .as_ref()
+                .unwrap_err()
+                .contains("panicked")
+        );
+        assert_eq!(results[3].response, Ok("two".to_string()));
+    }
+}
@@ -1,9 +1,16 @@
+use crate::context;
+use crate::persona;
+use crate::ui::{info, warning};
 use anyhow::{Context, Result, anyhow};
-use serde::Deserialize;
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::env;
 use std::fs;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 
 #[derive(Deserialize, Debug)]
+#[serde(deny_unknown_fields)]
 pub struct Persona {
     pub name: String,
     pub model: String,
@@ -11,31 +18,1169 @@ pub struct Persona {
 
     #[serde(default)]
     pub context_paths: Vec<String>,
+
+    // required by some vendors (anthropic), optional elsewhere
+    pub max_tokens: Option<u32>,
 }
 
-fn get_personas_dir() -> Result<PathBuf> {
+// global settings shared by every persona, read from config.toml (or .yaml)
+#[derive(Serialize, Deserialize, Debug, Default)]
+#[serde(deny_unknown_fields)]
+pub struct Config {
+    #[serde(default)]
+    pub api_keys: ApiKeys,
+
+    pub ollama_base_url: Option<String>,
+
+    // openai-compatible server for "custom:<model>" personas, e.g.
+    // "http://localhost:8080/v1"
+    pub custom_base_url: Option<String>,
+    // sent when the persona's model is just "custom"
+    pub custom_model: Option<String>,
+
+    pub azure_endpoint: Option<String>,
+    // used when the persona's model is a bare "azure:"; a name after it wins
+    pub azure_deployment: Option<String>,
+    pub azure_api_version: Option<String>,
+
+    // bedrock falls back to the aws sdk's own region lookup
+    pub aws_region: Option<String>,
+
+    // ask replays past exchanges unless this is false
+    pub persist_history: Option<bool>,
+    pub history_file: Option<String>,
+    // past this many turns, ask condenses the history (default 20)
+    pub max_history_turns: Option<usize>,
+    // ask the model for the summary; when false the full history is sent (default true)
+    pub auto_summarize: Option<bool>,
+
+    // cap on `ask --capture` output and git status sent to the model
+    pub max_capture_bytes: Option<usize>,
+    // cap on files inlined through @path references
+    pub max_context_bytes: Option<usize>,
+
+    // branch, last commit and status go into the system prompt unless false
+    pub inject_git_context: Option<bool>,
+    // tools to look for on PATH and mention in the system prompt
+    pub system_context_tools: Option<Vec<String>>,
+    // bash, zsh, fish or sh; defaults to $SHELL when it's one of those
+    pub shell_preference: Option<String>,
+
+    // replaces every persona's model when set (also --model)
+    pub model: Option<String>,
+    // replaces every persona's system prompt when set (handy in profiles)
+    pub system_prompt: Option<String>,
+    // same, read from this file; system_prompt wins when both are set.
+    // In .aitermrc it must be a relative path inside the project
+    pub system_prompt_file: Option<String>,
+    // added after the persona's system prompt
+    pub system_prompt_append: Option<String>,
+    // put before the question by `aiterm explain`
+    pub explain_prefix: Option<String>,
+
+    // print "[tokens: ...]" after each response, when the vendor reports counts
+    pub show_token_usage: Option<bool>,
+    // warn once a run's estimated spend passes this many dollars
+    pub cost_warning_threshold_usd: Option<f64>,
+
+    // retries for rate limits and server errors, with 1s, 2s, 4s... backoff (default 3)
+    pub max_retries: Option<u32>,
+    // requests a minute, in bursts of up to as many, across runs; 0 or unset is unlimited
+    pub max_requests_per_minute: Option<u32>,
+    // prompt + completion tokens allowed per day, across runs; 0 or unset is unlimited
+    pub max_daily_tokens: Option<u64>,
+    // seconds to wait for a whole response, or for each chunk when streaming (default 30)
+    pub request_timeout_seconds: Option<u64>,
+    // how long to wait for the connection itself (default 10)
+    pub connect_timeout_seconds: Option<u64>,
+
+    // serve Prometheus metrics on http://<this>/metrics, e.g. ":9090" (localhost
+    // only) or "0.0.0.0:9090"; only useful for runs that last, like `aiterm watch`
+    pub metrics_addr: Option<String>,
+
+    // proxy for every API call but bedrock, e.g. "http://proxy.corp:3128";
+    // HTTP_PROXY / HTTPS_PROXY are used when this is unset
+    pub http_proxy: Option<String>,
+    // accept any certificate (self-signed proxies); insecure (not bedrock)
+    pub tls_skip_verify: Option<bool>,
+
+    // format Markdown in (non-streamed) answers; defaults to on for a terminal
+    // unless NO_COLOR is set
+    pub render_markdown: Option<bool>,
+    // spinner while waiting for the answer; defaults to on for a terminal
+    pub show_spinner: Option<bool>,
+    // show answers through a pager, when stdout is a terminal (default false)
+    pub use_pager: Option<bool>,
+    // the pager to use; defaults to "less -R"
+    pub pager: Option<String>,
+
+    // named overrides selected with --profile, e.g. [profiles.work]
+    #[serde(default)]
+    pub profiles: BTreeMap<String, serde_json::Value>,
+
+    // prompts for `aiterm template run`, e.g. [templates] script = "... {{.Task}}"
+    #[serde(default)]
+    pub templates: BTreeMap<String, String>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Default)]
+#[serde(deny_unknown_fields)]
+pub struct ApiKeys {
+    pub gemini: Option<String>,
+    pub openai: Option<String>,
+    pub anthropic: Option<String>,
+    pub mistral: Option<String>,
+    pub azure: Option<String>,
+    pub xai: Option<String>,
+    pub cohere: Option<String>,
+    // optional: local servers usually don't check it
+    pub custom: Option<String>,
+}
+
+impl ApiKeys {
+    // (provider, env var fallback, configured key)
+    fn entries(&self) -> Vec<(&'static str, &'static str, &Option<String>)> {
+        vec![
+            ("gemini", "GEMINI_API_KEY", &self.gemini),
+            ("openai", "OPENAI_API_KEY", &self.openai),
+            ("anthropic", "ANTHROPIC_API_KEY", &self.anthropic),
+            ("mistral", "MISTRAL_API_KEY", &self.mistral),
+            ("azure", "AZURE_OPENAI_API_KEY", &self.azure),
+            ("xai", "XAI_API_KEY", &self.xai),
+            ("cohere", "COHERE_API_KEY", &self.cohere),
+            ("custom", "CUSTOM_API_KEY", &self.custom),
+        ]
+    }
+}
+
+impl Config {
+    // key from config.toml, falling back to the provider's env var
+    pub fn get_api_key(&self, provider: &str) -> Result<String> {
+        let Some((_, env_var, key)) = self
+            .api_keys
+            .entries()
+            .into_iter()
+            .find(|(name, _, _)| *name == provider)
+        else {
+            return Err(anyhow!("Unknown provider '{}'", provider));
+        };
+        if let Some(key) = key.as_ref().filter(|k| !k.is_empty()) {
+            return Ok(key.clone());
+        }
+        env::var(env_var).map_err(|_| anyhow!("{} environment variable not set.", env_var))
+    }
+
+    pub fn rate_limit_path(&self) -> Result<PathBuf> {
+        Ok(get_config_dir()?.join("ratelimit.json"))
+    }
+
+    pub fn history_path(&self) -> Result<PathBuf> {
+        match &self.history_file {
+            Some(path) => expand_path(path),
+            None => Ok(get_config_dir()?.join("history.jsonl")),
+        }
+    }
+}
+
+// "~/x", "$HOME/x" and "${XDG_DATA_HOME}/x" work anywhere aiterm takes a
+// path; symlinks are resolved when the path exists
+pub fn expand_path(path: &str) -> Result<PathBuf> {
+    let mut expanded = String::new();
+    let mut rest = path;
+    if path == "~" || path.starts_with("~/") {
+        let home = dirs::home_dir().ok_or_else(|| anyhow!("Could not find the home directory."))?;
+        expanded.push_str(&home.to_string_lossy());
+        rest = &path[1..];
+    }
+    while let Some(idx) = rest.find('$') {
+        expanded.push_str(&rest[..idx]);
+        let after = &rest[idx + 1..];
+        let (name, tail) = match after.strip_prefix('{') {
+            Some(braced) => {
+                let end = braced
+                    .find('}')
+                    .ok_or_else(|| anyhow!("Unclosed ${{ in path: {:?}", path))?;
+                (&braced[..end], &braced[end + 1..])
+            }
+            None => {
+                let end = after
+                    .find(|c: char| !(c.is_ascii_alphanumeric() || c == '_'))
+                    .unwrap_or(after.len());
+                (&after[..end], &after[end..])
+            }
+        };
+        // a lone "$" is just a character
+        if name.is_empty() {
+            expanded.push('$');
+            rest = after;
+            continue;
+        }
+        let value = env::var(name).with_context(|| {
+            format!(
+                "Environment variable {} used in path {:?} is not set",
+                name, path
+            )
+        })?;
+        expanded.push_str(&value);
+        rest = tail;
+    }
+    expanded.push_str(rest);
+
+    let expanded = PathBuf::from(expanded);
+    Ok(fs::canonicalize(&expanded).unwrap_or(expanded))
+}
+
+fn get_config_dir() -> Result<PathBuf> {
     let config_dir =
         dirs::config_dir().ok_or_else(|| anyhow!("Could not find a valid config directory."))?;
-    Ok(config_dir.join("aiterm").join("personas"))
+    Ok(config_dir.join("aiterm"))
 }
 
-pub fn load_persona(name: &str) -> Result<Persona> {
-    let personas_dir = get_personas_dir()?;
-    let persona_file = personas_dir.join(format!("{}.toml", name));
+fn get_personas_dir() -> Result<PathBuf> {
+    Ok(get_config_dir()?.join("personas"))
+}
 
-    if !persona_file.exists() {
+const MAX_TOKENS_LIMIT: u32 = 32768;
+// every hosted vendor's keys are at least this long. Servers behind
+// custom_base_url pick their own (often "none" or a short token), and ollama
+// takes no key, so only whitespace is checked for those
+const MIN_API_KEY_LEN: usize = 16;
+const FREE_FORM_KEYS: &[&str] = &["custom"];
+
+// every problem at once, so one edit can fix them all
+pub fn validate(cfg: &Config) -> Vec<String> {
+    let mut problems = Vec::new();
+    for (provider, _, key) in cfg.api_keys.entries() {
+        let Some(key) = key.as_deref().filter(|k| !k.is_empty()) else {
+            continue;
+        };
+        if key.chars().any(char::is_whitespace) {
+            problems.push(format!("api_keys.{} contains whitespace", provider));
+        } else if key.len() < MIN_API_KEY_LEN && !FREE_FORM_KEYS.contains(&provider) {
+            problems.push(format!(
+                "api_keys.{} is too short to be a valid key",
+                provider
+            ));
+        }
+    }
+    if let Some(shell) = &cfg.shell_preference {
+        if !context::SCRIPT_SHELLS.contains(&shell.as_str()) {
+            problems.push(format!(
+                "shell_preference must be one of {}",
+                context::SCRIPT_SHELLS.join(", ")
+            ));
+        }
+    }
+    for (name, value) in [
+        ("request_timeout_seconds", cfg.request_timeout_seconds),
+        ("connect_timeout_seconds", cfg.connect_timeout_seconds),
+        ("max_history_turns", cfg.max_history_turns.map(|n| n as u64)),
+    ] {
+        if value == Some(0) {
+            problems.push(format!("{} must be at least 1", name));
+        }
+    }
+    problems
+}
+
+pub fn validate_persona(persona: &Persona) -> Vec<String> {
+    let mut problems = Vec::new();
+    if persona.model.trim().is_empty() {
+        problems.push("model must not be empty".to_string());
+    }
+    if let Some(max_tokens) = persona.max_tokens {
+        if max_tokens == 0 || max_tokens > MAX_TOKENS_LIMIT {
+            problems.push(format!(
+                "max_tokens must be between 1 and {}, got {}",
+                MAX_TOKENS_LIMIT, max_tokens
+            ));
+        }
+    }
+    problems
+}
+
+fn ensure_valid(problems: Vec<String>, path: &Path) -> Result<()> {
+    if problems.is_empty() {
+        return Ok(());
+    }
+    Err(anyhow!(
+        "Invalid settings in {:?}:\n  - {}",
+        path,
+        problems.join("\n  - ")
+    ))
+}
+
+// config and persona files are TOML unless the extension says YAML or JSON
+fn parse_file<T: DeserializeOwned>(path: &Path) -> Result<T> {
+    let file_content =
+        fs::read_to_string(path).with_context(|| format!("Failed to read file: {:?}", path))?;
+
+    match path.extension().and_then(|ext| ext.to_str()) {
+        Some("yaml") | Some("yml") => serde_yaml::from_str(&file_content)
+            .with_context(|| format!("Failed to parse YAML: {:?}", path)),
+        Some("json") => serde_json::from_str(&file_content)
+            .with_context(|| format!("Failed to parse JSON: {:?}", path)),
+        _ => toml::from_str(&file_content)
+            .with_context(|| format!("Failed to parse TOML: {:?}", path)),
+    }
+}
+
+// first of <stem>.yaml, <stem>.yml, <stem>.json, <stem>.toml that exists
+fn find_file(dir: &Path, stem: &str) -> Option<PathBuf> {
+    ["yaml", "yml", "json", "toml"]
+        .iter()
+        .map(|ext| dir.join(format!("{}.{}", stem, ext)))
+        .find(|path| path.exists())
+}
+
+// where `config init` writes when no --config is given
+pub fn default_config_path(extension: &str) -> Result<PathBuf> {
+    Ok(get_config_dir()?.join(format!("config.{}", extension)))
+}
+
+pub fn get_config_path(explicit: Option<&str>) -> Result<PathBuf> {
+    if let Some(path) = explicit {
+        return expand_path(path);
+    }
+    // containers and CI point at their own file, created on first use
+    if let Some(path) = env::var("AITERM_CONFIG").ok().filter(|p| !p.is_empty()) {
+        let path = expand_path(&path)?;
+        if !path.exists() {
+            write_default_config(&path)?;
+        }
+        return Ok(path);
+    }
+    // config.toml first, since that's what `config init` writes, then
+    // config.yaml, config.yml and config.json. Any others are ignored
+    let config_dir = get_config_dir()?;
+    let mut found = ["toml", "yaml", "yml", "json"]
+        .iter()
+        .map(|ext| config_dir.join(format!("config.{}", ext)))
+        .filter(|path| path.exists());
+    let Some(path) = found.next() else {
+        return Ok(config_dir.join("config.toml"));
+    };
+    for ignored in found {
+        warning!("{:?} is ignored because {:?} exists", ignored, path);
+    }
+    Ok(path)
+}
+
+fn write_default_config(path: &Path) -> Result<()> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create config dir: {:?}", parent))?;
+    }
+    let content = match path.extension().and_then(|ext| ext.to_str()) {
+        Some("yaml") | Some("yml") => {
+            "# aiterm config\n# request_timeout_seconds: 30\n# connect_timeout_seconds: 10\n{}\n"
+        }
+        // no comments in JSON
+        Some("json") => "{}\n",
+        _ => "# aiterm config\n# request_timeout_seconds = 30\n# connect_timeout_seconds = 10\n",
+    };
+    fs::write(path, content)
+        .with_context(|| format!("Failed to create config file: {:?}", path))?;
+    info!("Created config file: {:?}", path);
+    Ok(())
+}
+
+pub fn load_config(explicit: Option<&str>) -> Result<Config> {
+    let config_file = get_config_path(explicit)?;
+    if !config_file.exists() {
+        if explicit.is_some() {
+            return Err(anyhow!("Config file not found: {:?}", config_file));
+        }
+        return Ok(Config::default());
+    }
+    let config: Config = parse_file(&config_file)?;
+    ensure_valid(validate(&config), &config_file)?;
+    Ok(config)
+}
+
+// profile fields replace the base ones; tables are merged key by key
+pub fn load_profile(explicit: Option<&str>, name: &str) -> Result<Config> {
+    let config_file = get_config_path(explicit)?;
+    if !config_file.exists() {
+        return Err(anyhow!(
+            "Profile '{}' not found: no config file at {:?}",
+            name,
+            config_file
+        ));
+    }
+
+    let mut root: serde_json::Value = parse_file(&config_file)?;
+    let base: Config = serde_json::from_value(root.clone())
+        .with_context(|| format!("Failed to parse config: {:?}", config_file))?;
+
+    let Some(profile) = base.profiles.get(name) else {
+        let available: Vec<&str> = base.profiles.keys().map(String::as_str).collect();
         return Err(anyhow!(
-            "Persona file not found: {:?}\nWill put a cool default later on",
-            persona_file
+            "Profile '{}' not found. Available profiles: {}",
+            name,
+            if available.is_empty() {
+                "(none)".to_string()
+            } else {
+                available.join(", ")
+            }
         ));
+    };
+    merge(&mut root, profile.clone());
+
+    let config: Config = serde_json::from_value(root)
+        .with_context(|| format!("Failed to apply profile '{}': {:?}", name, config_file))?;
+    ensure_valid(validate(&config), &config_file)?;
+    Ok(config)
+}
+
+pub const PROJECT_CONFIG_FILE: &str = ".aitermrc";
+
+// the only settings a checked-out repo may change. Anything else could send
+// keys or prompts somewhere new (base URLs, proxies), run a program (pager),
+// write files (history_file), open a port or run up the bill
+const PROJECT_ALLOWED: &[&str] = &[
+    "model",
+    "custom_model",
+    "azure_deployment",
+    "system_prompt",
+    "system_prompt_file",
+    "system_prompt_append",
+    "explain_prefix",
+    "shell_preference",
+    "inject_git_context",
+    "system_context_tools",
+    "max_history_turns",
+    "auto_summarize",
+    "max_capture_bytes",
+    "max_context_bytes",
+    "show_token_usage",
+    "render_markdown",
+    "show_spinner",
+    "templates",
+];
+
+// the nearest .aitermrc in start_dir or above it, like git finds .git
+pub fn find_project_config(start_dir: &Path) -> Option<PathBuf> {
+    start_dir
+        .ancestors()
+        .map(|dir| dir.join(PROJECT_CONFIG_FILE))
+        .find(|path| path.is_file())
+}
+
+// project settings replace the user's, for the keys in PROJECT_ALLOWED.
+// .aitermrc is TOML
+pub fn apply_project_config(base: Config, path: &Path) -> Result<Config> {
+    let dir = path.parent().unwrap_or(Path::new("."));
+    let (overlay, ignored) = filter_project_config(parse_file(path)?, dir);
+    for reason in ignored {
+        warning!(
+            "{} in {:?} is ignored; set it in your own config",
+            reason,
+            path
+        );
+    }
+    let mut root = serde_json::to_value(&base)?;
+    merge(&mut root, overlay);
+    let config: Config = serde_json::from_value(root)
+        .with_context(|| format!("Failed to apply project config: {:?}", path))?;
+    ensure_valid(validate(&config), path)?;
+    Ok(config)
+}
+
+// the part of a project config that may be applied, plus what was dropped.
+// system_prompt_file is resolved against the project dir and has to stay in it
+fn filter_project_config(
+    overlay: serde_json::Value,
+    project_dir: &Path,
+) -> (serde_json::Value, Vec<String>) {
+    let serde_json::Value::Object(table) = overlay else {
+        return (overlay, Vec::new());
+    };
+    let mut kept = serde_json::Map::new();
+    let mut ignored = Vec::new();
+    for (key, value) in table {
+        if !PROJECT_ALLOWED.contains(&key.as_str()) {
+            ignored.push(key);
+            continue;
+        }
+        if key == "system_prompt_file" {
+            match value
+                .as_str()
+                .and_then(|file| inside_dir(project_dir, file))
+            {
+                Some(file) => {
+                    kept.insert(key, serde_json::Value::String(file));
+                }
+                None => ignored.push(format!("system_prompt_file {}", value)),
+            }
+            continue;
+        }
+        kept.insert(key, value);
+    }
+    (serde_json::Value::Object(kept), ignored)
+}
+
+// `file` under `dir`, if it is a relative path that really ends up there
+// (no .., no symlink out of the tree)
+fn inside_dir(dir: &Path, file: &str) -> Option<String> {
+    let relative = Path::new(file);
+    let plain = relative.components().all(|part| {
+        matches!(
+            part,
+            std::path::Component::Normal(_) | std::path::Component::CurDir
+        )
+    });
+    if !plain {
+        return None;
+    }
+    let dir = dir.canonicalize().ok()?;
+    let resolved = dir.join(relative).canonicalize().ok()?;
+    resolved
+        .starts_with(&dir)
+        .then(|| resolved.to_string_lossy().into_owned())
+}
+
+fn merge(base: &mut serde_json::Value, overlay: serde_json::Value) {
+    match (base, overlay) {
+        (serde_json::Value::Object(base), serde_json::Value::Object(overlay)) => {
+            for (key, value) in overlay {
+                merge(base.entry(key).or_insert(serde_json::Value::Null), value);
+            }
+        }
+        (base, overlay) => *base = overlay,
     }
+}
+
+// every setting that has a value, as dotted keys ("api_keys.openai")
+pub fn settings(cfg: &Config) -> Result<Vec<(String, String)>> {
+    let mut out = Vec::new();
+    flatten("", &serde_json::to_value(cfg)?, &mut out);
+    Ok(out)
+}
 
-    let file_content = fs::read_to_string(&persona_file)
-        .with_context(|| format!("Failed to read persona file: {:?}", persona_file))?;
+// a setting that isn't at its default. `default` is None for settings with
+// no fixed default: they're additions rather than changes
+pub struct FieldDiff {
+    pub key: String,
+    pub default: Option<String>,
+    pub value: String,
+}
 
-    let persona: Persona = toml::from_str(&file_content)
-        .with_context(|| format!("Failed to parse TOML: {:?}", persona_file))?;
+// the settings in `cfg` that differ from what aiterm would use unset
+pub fn diff(cfg: &Config) -> Result<Vec<FieldDiff>> {
+    let mut defaults = Vec::new();
+    for field in starter_fields() {
+        if let Some(default) = &field.default {
+            flatten(field.key, default, &mut defaults);
+        }
+    }
+    let mut diffs = Vec::new();
+    for (key, value) in settings(cfg)? {
+        let default = defaults
+            .iter()
+            .find(|(k, _)| *k == key)
+            .map(|(_, v)| v.clone());
+        if default.as_ref() != Some(&value) {
+            diffs.push(FieldDiff {
+                key,
+                default,
+                value,
+            });
+        }
+    }
+    Ok(diffs)
+}
+
+fn flatten(prefix: &str, value: &serde_json::Value, out: &mut Vec<(String, String)>) {
+    match value {
+        serde_json::Value::Null => {}
+        serde_json::Value::Object(map) => {
+            for (key, value) in map {
+                let key = if prefix.is_empty() {
+                    key.clone()
+                } else {
+                    format!("{}.{}", prefix, key)
+                };
+                flatten(&key, value, out);
+            }
+        }
+        serde_json::Value::String(s) => out.push((prefix.to_string(), s.clone())),
+        value => out.push((prefix.to_string(), value.to_string())),
+    }
+}
 
+// writes one setting into the config file and returns the updated config.
+// The value is tried as a bool, an integer, a float, a string and then a
+// comma-separated list, and the first the key accepts wins. Comments in the
+// file are not kept.
+pub fn set(explicit: Option<&str>, key: &str, value: &str) -> Result<Config> {
+    let config_file = get_config_path(explicit)?;
+    let root: serde_json::Value = if config_file.exists() {
+        parse_file(&config_file)?
+    } else {
+        serde_json::Value::Object(Default::default())
+    };
+
+    let mut last_error = None;
+    for candidate in candidates(value) {
+        let mut updated = root.clone();
+        set_path(&mut updated, key, candidate)?;
+        match serde_json::from_value::<Config>(updated.clone()) {
+            Ok(config) => {
+                ensure_valid(validate(&config), &config_file)?;
+                write_file(&config_file, &updated)?;
+                return Ok(config);
+            }
+            Err(e) => last_error = Some(e),
+        }
+    }
+    Err(anyhow!(
+        "Can't set {} to {:?}: {}",
+        key,
+        value,
+        last_error.map(|e| e.to_string()).unwrap_or_default()
+    ))
+}
+
+// takes `key` out of the config file, or every setting but RESET_KEPT when
+// there is no key, so it falls back to its default. `confirm` sees what
+// would go and can call it off. Returns what was removed, or None when
+// called off.
+// what a full reset leaves alone: secrets and the user's own named entries,
+// which have no default to fall back to
+const RESET_KEPT: &[&str] = &["api_keys", "profiles", "templates"];
+
+pub fn reset(
+    explicit: Option<&str>,
+    key: Option<&str>,
+    confirm: impl FnOnce(&[(String, String)]) -> Result<bool>,
+) -> Result<Option<Vec<(String, String)>>> {
+    let config_file = get_config_path(explicit)?;
+    if !config_file.exists() {
+        return Ok(Some(vec![]));
+    }
+    let mut root: serde_json::Value = parse_file(&config_file)?;
+    let mut removed = Vec::new();
+    match key {
+        Some(key) => {
+            if let Some(value) = remove_path(&mut root, key) {
+                flatten(key, &value, &mut removed);
+            }
+        }
+        None => {
+            if let serde_json::Value::Object(map) = &mut root {
+                map.retain(|key, value| {
+                    if RESET_KEPT.contains(&key.as_str()) {
+                        return true;
+                    }
+                    flatten(key, value, &mut removed);
+                    false
+                });
+            }
+        }
+    }
+    if removed.is_empty() {
+        return Ok(Some(removed));
+    }
+    if !confirm(&removed)? {
+        return Ok(None);
+    }
+
+    let empty = root.as_object().is_none_or(|map| map.is_empty());
+    if empty {
+        fs::remove_file(&config_file)
+            .with_context(|| format!("Failed to reset config: {:?}", config_file))?;
+        write_default_config(&config_file)?;
+    } else {
+        write_file(&config_file, &root)?;
+    }
+    Ok(Some(removed))
+}
+
+fn remove_path(root: &mut serde_json::Value, key: &str) -> Option<serde_json::Value> {
+    let (parent, last) = match key.rsplit_once('.') {
+        Some((parent, last)) => (
+            parent
+                .split('.')
+                .try_fold(root, |node, part| node.get_mut(part))?,
+            last,
+        ),
+        None => (root, key),
+    };
+    parent.as_object_mut()?.remove(last)
+}
+
+fn candidates(value: &str) -> Vec<serde_json::Value> {
+    let mut candidates = Vec::new();
+    if let Ok(b) = value.parse::<bool>() {
+        candidates.push(b.into());
+    }
+    if let Ok(i) = value.parse::<i64>() {
+        candidates.push(i.into());
+    }
+    if let Some(n) = value
+        .parse::<f64>()
+        .ok()
+        .and_then(serde_json::Number::from_f64)
+    {
+        candidates.push(serde_json::Value::Number(n));
+    }
+    candidates.push(value.into());
+    candidates.push(value.split(',').map(|item| item.trim()).collect());
+    candidates
+}
+
+fn set_path(root: &mut serde_json::Value, key: &str, value: serde_json::Value) -> Result<()> {
+    let mut node = root;
+    let mut parts = key.split('.').peekable();
+    while let Some(part) = parts.next() {
+        if part.is_empty() {
+            return Err(anyhow!("Invalid key: {:?}", key));
+        }
+        if !node.is_object() {
+            *node = serde_json::Value::Object(Default::default());
+        }
+        let map = node.as_object_mut().expect("made an object above");
+        if parts.peek().is_none() {
+            map.insert(part.to_string(), value);
+            return Ok(());
+        }
+        node = map
+            .entry(part.to_string())
+            .or_insert_with(|| serde_json::Value::Object(Default::default()));
+    }
+    Ok(())
+}
+
+fn write_file(path: &Path, value: &serde_json::Value) -> Result<()> {
+    let content = match path.extension().and_then(|ext| ext.to_str()) {
+        Some("yaml") | Some("yml") => serde_yaml::to_string(value)?,
+        Some("json") => serde_json::to_string_pretty(value)? + "\n",
+        _ => toml::to_string(value)?,
+    };
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create config dir: {:?}", parent))?;
+    }
+    fs::write(path, content).with_context(|| format!("Failed to write config: {:?}", path))
+}
+
+// one documented setting in the starter config. `default` is None when it
+// depends on the machine; the example is shown instead.
+struct StarterField {
+    key: &'static str,
+    kind: &'static str,
+    default: Option<serde_json::Value>,
+    example: serde_json::Value,
+    doc: &'static str,
+}
+
+fn starter_fields() -> Vec<StarterField> {
+    use serde_json::json;
+    let field = |key, kind, default: Option<serde_json::Value>, example, doc| StarterField {
+        key,
+        kind,
+        example: default.clone().unwrap_or(example),
+        default,
+        doc,
+    };
+    vec![
+        field(
+            "model",
+            "string",
+            None,
+            json!("openai:gpt-4o"),
+            "replaces every persona's model (also --model)",
+        ),
+        field(
+            "system_prompt",
+            "string",
+            None,
+            json!("You are a terse assistant."),
+            "replaces every persona's system prompt",
+        ),
+        field(
+            "system_prompt_file",
+            "string",
+            None,
+            json!("./aiterm-prompt.txt"),
+            "same, read from a file; system_prompt wins when both are set",
+        ),
+        field(
+            "system_prompt_append",
+            "string",
+            None,
+            json!("Prefer POSIX tools."),
+            "added after the persona's system prompt",
+        ),
+        field(
+            "explain_prefix",
+            "string",
+            Some(json!(
+                "Explain the following in detail without generating executable commands: "
+            )),
+            json!(null),
+            "put before the question by `aiterm explain`",
+        ),
+        field(
+            "ollama_base_url",
+            "string",
+            Some(json!("http://localhost:11434")),
+            json!(null),
+            "Ollama server for \"ollama:<model>\" personas",
+        ),
+        field(
+            "custom_base_url",
+            "string",
+            None,
+            json!("http://localhost:8080/v1"),
+            "openai-compatible server for \"custom:<model>\" personas",
+        ),
+        field(
+            "custom_model",
+            "string",
+            None,
+            json!("llama-3.1-8b-instruct"),
+            "sent when the persona's model is just \"custom\"",
+        ),
+        field(
+            "azure_endpoint",
+            "string",
+            None,
+            json!("https://myresource.openai.azure.com"),
+            "Azure OpenAI resource",
+        ),
+        field(
+            "azure_deployment",
+            "string",
+            None,
+            json!("gpt-4o"),
+            "for a bare \"azure:\" model; a name after \"azure:\" wins",
+        ),
+        field(
+            "azure_api_version",
+            "string",
+            Some(json!("2024-02-01")),
+            json!(null),
+            "Azure OpenAI API version",
+        ),
+        field(
+            "aws_region",
+            "string",
+            None,
+            json!("us-east-1"),
+            "Bedrock region; the AWS SDK's own lookup is used when unset",
+        ),
+        field(
+            "persist_history",
+            "boolean",
+            Some(json!(true)),
+            json!(null),
+            "ask replays and records past exchanges",
+        ),
+        field(
+            "history_file",
+            "string",
+            None,
+            json!("~/.local/share/aiterm/history.jsonl"),
+            "defaults to history.jsonl in the config directory",
+        ),
+        field(
+            "max_history_turns",
+            "integer",
+            Some(json!(20)),
+            json!(null),
+            "past this many turns, ask condenses the history",
+        ),
+        field(
+            "auto_summarize",
+            "boolean",
+            Some(json!(true)),
+            json!(null),
+            "summarize with the model; when false the full history is sent",
+        ),
+        field(
+            "max_capture_bytes",
+            "integer",
+            Some(json!(context::DEFAULT_MAX_CAPTURE_BYTES)),
+            json!(null),
+            "cap on `ask --capture` output and git status sent to the model",
+        ),
+        field(
+            "max_context_bytes",
+            "integer",
+            Some(json!(context::DEFAULT_MAX_CONTEXT_BYTES)),
+            json!(null),
+            "cap on files inlined through @path references",
+        ),
+        field(
+            "inject_git_context",
+            "boolean",
+            Some(json!(true)),
+            json!(null),
+            "branch, last commit and status go into the system prompt",
+        ),
+        field(
+            "system_context_tools",
+            "array",
+            Some(json!(context::DEFAULT_SYSTEM_CONTEXT_TOOLS)),
+            json!(null),
+            "tools to look for on PATH and mention in the system prompt",
+        ),
+        field(
+            "shell_preference",
+            "string",
+            None,
+            json!("bash"),
+            "bash, zsh, fish or sh; defaults to $SHELL when it's one of those",
+        ),
+        field(
+            "show_token_usage",
+            "boolean",
+            Some(json!(false)),
+            json!(null),
+            "print \"[tokens: ...]\" after each response",
+        ),
+        field(
+            "cost_warning_threshold_usd",
+            "number",
+            None,
+            json!(1.0),
+            "warn once a run's estimated spend passes this many dollars",
+        ),
+        field(
+            "max_retries",
+            "integer",
+            Some(json!(3)),
+            json!(null),
+            "retries for rate limits and server errors, with 1s, 2s, 4s... backoff",
+        ),
+        field(
+            "max_requests_per_minute",
+            "integer",
+            Some(json!(0)),
+            json!(null),
+            "requests a minute, in bursts of up to as many, across runs (0 = unlimited)",
+        ),
+        field(
+            "max_daily_tokens",
+            "integer",
+            Some(json!(0)),
+            json!(null),
+            "prompt + completion tokens allowed per day, across runs (0 = unlimited)",
+        ),
+        field(
+            "request_timeout_seconds",
+            "integer",
+            Some(json!(30)),
+            json!(null),
+            "wait for a whole response, or for each chunk when streaming",
+        ),
+        field(
+            "connect_timeout_seconds",
+            "integer",
+            Some(json!(10)),
+            json!(null),
+            "wait for the connection itself",
+        ),
+        field(
+            "metrics_addr",
+            "string",
+            None,
+            json!(":9090"),
+            "serve Prometheus metrics at http://<addr>/metrics while aiterm runs; \":port\" is localhost only",
+        ),
+        field(
+            "http_proxy",
+            "string",
+            None,
+            json!("http://proxy.corp:3128"),
+            "proxy for every API call but bedrock; HTTP_PROXY / HTTPS_PROXY when unset",
+        ),
+        field(
+            "tls_skip_verify",
+            "boolean",
+            Some(json!(false)),
+            json!(null),
+            "accept any certificate (self-signed proxies); insecure",
+        ),
+        field(
+            "render_markdown",
+            "boolean",
+            None,
+            json!(true),
+            "format Markdown in answers; on for a terminal unless NO_COLOR is set",
+        ),
+        field(
+            "show_spinner",
+            "boolean",
+            None,
+            json!(true),
+            "spinner while waiting; on for a terminal",
+        ),
+        field(
+            "use_pager",
+            "boolean",
+            Some(json!(false)),
+            json!(null),
+            "show answers through a pager when stdout is a terminal",
+        ),
+        field(
+            "pager",
+            "string",
+            Some(json!("less -R")),
+            json!(null),
+            "the pager to use",
+        ),
+    ]
+}
+
+// a config with every setting documented, in the format the path's
+// extension names. TOML and YAML get every line commented out, so the file
+// changes nothing until edited; JSON can't hold comments, so it gets the
+// fixed defaults and a <stem>.schema.json next to it describing them all.
+// Returns the files written.
+pub fn generate_starter(path: &Path) -> Result<Vec<PathBuf>> {
+    let fields = starter_fields();
+    let mut written = vec![path.to_path_buf()];
+    let content = match path.extension().and_then(|ext| ext.to_str()) {
+        Some("json") => {
+            let mut root = serde_json::Map::new();
+            for f in &fields {
+                if let Some(default) = &f.default {
+                    root.insert(f.key.to_string(), default.clone());
+                }
+            }
+            let schema_path = path.with_extension("schema.json");
+            let schema = serde_json::to_string_pretty(&starter_schema(&fields))? + "\n";
+            fs::write(&schema_path, schema)
+                .with_context(|| format!("Failed to write schema: {:?}", schema_path))?;
+            written.push(schema_path);
+            serde_json::to_string_pretty(&root)? + "\n"
+        }
+        Some("yaml") | Some("yml") => {
+            let mut out = String::from(STARTER_HEADER);
+            for f in &fields {
+                out.push_str(&format!("\n# {}\n# {}: {}\n", f.doc, f.key, f.example));
+            }
+            out.push_str("\n# keys fall back to these environment variables\n# api_keys:\n");
+            for (provider, env_var, _) in ApiKeys::default().entries() {
+                out.push_str(&format!("#   {}: \"\"  # {}\n", provider, env_var));
+            }
+            out.push_str(STARTER_PROFILES_YAML);
+            out.push_str(STARTER_TEMPLATES_YAML);
+            out.push_str("{}\n");
+            out
+        }
+        _ => {
+            let mut out = String::from(STARTER_HEADER);
+            for f in &fields {
+                out.push_str(&format!("\n# {}\n# {} = {}\n", f.doc, f.key, f.example));
+            }
+            out.push_str("\n# keys fall back to these environment variables\n# [api_keys]\n");
+            for (provider, env_var, _) in ApiKeys::default().entries() {
+                out.push_str(&format!("# {} = \"\"  # {}\n", provider, env_var));
+            }
+            out.push_str(STARTER_PROFILES_TOML);
+            out.push_str(STARTER_TEMPLATES_TOML);
+            out
+        }
+    };
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create config dir: {:?}", parent))?;
+    }
+    fs::write(path, content).with_context(|| format!("Failed to write config: {:?}", path))?;
+    Ok(written)
+}
+
+const STARTER_HEADER: &str = "# aiterm config. Every setting is optional: uncomment one to change it.\n\
+# Values shown are the defaults, or examples where the default depends on\n\
+# the machine.\n";
+
+const STARTER_PROFILES_TOML: &str = "\n# overrides picked with --profile work\n\
+# [profiles.work]\n\
+# model = \"openai:gpt-4o\"\n";
+
+const STARTER_PROFILES_YAML: &str = "\n# overrides picked with --profile work\n\
+# profiles:\n\
+#   work:\n\
+#     model: \"openai:gpt-4o\"\n";
+
+const STARTER_TEMPLATES_TOML: &str = "\n# prompts for `aiterm template run script Task=...`\n\
+# [templates]\n\
+# script = \"write a bash script to {{.Task}}\"\n";
+
+const STARTER_TEMPLATES_YAML: &str = "\n# prompts for `aiterm template run script Task=...`\n\
+# templates:\n\
+#   script: \"write a bash script to {{.Task}}\"\n";
+
+fn starter_schema(fields: &[StarterField]) -> serde_json::Value {
+    use serde_json::json;
+    let mut properties = serde_json::Map::new();
+    for f in fields {
+        let mut property = json!({ "type": f.kind, "description": f.doc });
+        if f.kind == "array" {
+            property["items"] = json!({ "type": "string" });
+        }
+        if let Some(default) = &f.default {
+            property["default"] = default.clone();
+        }
+        properties.insert(f.key.to_string(), property);
+    }
+    let keys: serde_json::Map<String, serde_json::Value> = ApiKeys::default()
+        .entries()
+        .into_iter()
+        .map(|(provider, env_var, _)| {
+            let doc = format!("falls back to {}", env_var);
+            (
+                provider.to_string(),
+                json!({ "type": "string", "description": doc }),
+            )
+        })
+        .collect();
+    properties.insert(
+        "api_keys".to_string(),
+        json!({ "type": "object", "additionalProperties": false, "properties": keys }),
+    );
+    properties.insert(
+        "profiles".to_string(),
+        json!({
+            "type": "object",
+            "description": "overrides picked with --profile <name>",
+            "additionalProperties": { "type": "object" },
+        }),
+    );
+    properties.insert(
+        "templates".to_string(),
+        json!({
+            "type": "object",
+            "description": "prompts for `aiterm template run <name>`",
+            "additionalProperties": { "type": "string" },
+        }),
+    );
+    json!({
+        "$schema": "http://json-schema.org/draft-07/schema#",
+        "title": "aiterm config",
+        "type": "object",
+        "additionalProperties": false,
+        "properties": properties,
+    })
+}
+
+pub fn load_persona(name: &str) -> Result<Persona> {
+    let personas_dir = get_personas_dir()?;
+    let Some(persona_file) = find_file(&personas_dir, name) else {
+        return persona::get(name).ok_or_else(|| {
+            anyhow!(
+                "Persona file not found: {:?}\nBuilt-in personas: {}",
+                personas_dir.join(format!("{}.toml", name)),
+                persona::BUILT_IN.join(", ")
+            )
+        });
+    };
+    let persona: Persona = parse_file(&persona_file)?;
+    ensure_valid(validate_persona(&persona), &persona_file)?;
     Ok(persona)
 }
 
@@ -45,3 +1190,202 @@ pub fn ensure_config_dir_exists() -> Result<()> {
         .with_context(|| format!("Failed to create config dir: {:?}", personas_dir))?;
     Ok(())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn expand_path_cases() {
+        let home = dirs::home_dir().unwrap();
+        let home = home.to_string_lossy();
+        let cases = [
+            ("plain/aiterm-missing", "plain/aiterm-missing".to_string()),
+            ("~/aiterm-missing", format!("{}/aiterm-missing", home)),
+            ("$HOME/aiterm-missing", format!("{}/aiterm-missing", home)),
+            ("${HOME}/aiterm-missing", format!("{}/aiterm-missing", home)),
+            (
+                "${HOME}x/aiterm-missing",
+                format!("{}x/aiterm-missing", home),
+            ),
+            ("cost$/aiterm-missing", "cost$/aiterm-missing".to_string()),
+            ("~user/aiterm-missing", "~user/aiterm-missing".to_string()),
+        ];
+        for (path, want) in cases {
+            assert_eq!(
+                expand_path(path).unwrap(),
+                PathBuf::from(want),
+                "{:?}",
+                path
+            );
+        }
+    }
+
+    #[test]
+    fn expand_path_errors() {
+        for path in [
+            "$AITERM_TEST_UNSET_VAR/x",
+            "${AITERM_TEST_UNSET_VAR}",
+            "${HOME/x",
+        ] {
+            assert!(expand_path(path).is_err(), "{:?}", path);
+        }
+    }
+
+    #[test]
+    fn merge_cases() {
+        let cases = [
+            (json!({"a": 1}), json!({"b": 2}), json!({"a": 1, "b": 2})),
+            (json!({"a": 1}), json!({"a": 2}), json!({"a": 2})),
+            (
+                json!({"api_keys": {"openai": "x", "gemini": "y"}}),
+                json!({"api_keys": {"openai": "z"}}),
+                json!({"api_keys": {"openai": "z", "gemini": "y"}}),
+            ),
+            // a table replaces a plain value, and the other way round
+            (
+                json!({"a": 1}),
+                json!({"a": {"b": 2}}),
+                json!({"a": {"b": 2}}),
+            ),
+            (json!({"a": {"b": 2}}), json!({"a": 1}), json!({"a": 1})),
+            (json!({"a": [1, 2]}), json!({"a": [3]}), json!({"a": [3]})),
+        ];
+        for (mut base, overlay, want) in cases {
+            let overlay_text = overlay.to_string();
+            merge(&mut base, overlay);
+            assert_eq!(base, want, "overlay {}", overlay_text);
+        }
+    }
+
+    fn names(list: &[&str]) -> Vec<String> {
+        list.iter().map(|name| name.to_string()).collect()
+    }
+
+    #[test]
+    fn project_config_filter() {
+        let dir = env::temp_dir().join(format!("aiterm-project-{}", std::process::id()));
+        fs::create_dir_all(dir.join("prompts")).unwrap();
+        fs::write(dir.join("prompts/sys.txt"), "be brief").unwrap();
+        let outside = dir.with_extension("outside.txt");
+        fs::write(&outside, "elsewhere").unwrap();
+        let inside = dir.canonicalize().unwrap().join("prompts/sys.txt");
+        let inside = inside.to_string_lossy();
+        let outside = outside.to_string_lossy();
+
+        let cases = [
+            (
+                json!({"model": "gpt-4o", "show_spinner": false, "templates": {"t": "x"}}),
+                json!({"model": "gpt-4o", "show_spinner": false, "templates": {"t": "x"}}),
+                Vec::new(),
+            ),
+            (
+                json!({"api_keys": {"openai": "sk"}, "ollama_base_url": "http://evil"}),
+                json!({}),
+                names(&["api_keys", "ollama_base_url"]),
+            ),
+            (
+                json!({"pager": "sh -c evil", "use_pager": true, "history_file": "/tmp/h"}),
+                json!({}),
+                names(&["history_file", "pager", "use_pager"]),
+            ),
+            (
+                json!({"custom_base_url": "http://x", "http_proxy": "http://p", "metrics_addr": ":1"}),
+                json!({}),
+                names(&["custom_base_url", "http_proxy", "metrics_addr"]),
+            ),
+            (
+                json!({"system_prompt_file": "prompts/sys.txt"}),
+                json!({"system_prompt_file": inside}),
+                Vec::new(),
+            ),
+            (
+                json!({"system_prompt_file": "./prompts/sys.txt"}),
+                json!({"system_prompt_file": inside}),
+                Vec::new(),
+            ),
+            (
+                json!({"system_prompt_file": outside}),
+                json!({}),
+                vec![format!("system_prompt_file \"{}\"", outside)],
+            ),
+            (
+                json!({"system_prompt_file": "../x.txt"}),
+                json!({}),
+                vec!["system_prompt_file \"../x.txt\"".to_string()],
+            ),
+            (
+                json!({"system_prompt_file": "~/prompts/sys.txt"}),
+                json!({}),
+                vec!["system_prompt_file \"~/prompts/sys.txt\"".to_string()],
+            ),
+            (
+                json!({"system_prompt_file": "prompts/missing.txt"}),
+                json!({}),
+                vec!["system_prompt_file \"prompts/missing.txt\"".to_string()],
+            ),
+        ];
+        for (overlay, want, want_ignored) in cases {
+            let overlay_text = overlay.to_string();
+            let (got, ignored) = filter_project_config(overlay, &dir);
+            assert_eq!(got, want, "overlay {}", overlay_text);
+            assert_eq!(ignored, want_ignored, "overlay {}", overlay_text);
+        }
+        fs::remove_dir_all(&dir).unwrap();
+        fs::remove_file(outside.as_ref()).unwrap();
+    }
+
+    #[test]
+    fn api_key_checks() {
+        let long = "sk-0123456789abcdef";
+        let cases = [
+            (json!({"openai": long}), Vec::new()),
+            (
+                json!({"openai": "sk-short"}),
+                names(&["api_keys.openai is too short to be a valid key"]),
+            ),
+            (json!({"custom": "none"}), Vec::new()),
+            (json!({"custom": ""}), Vec::new()),
+            (
+                json!({"custom": "has space"}),
+                names(&["api_keys.custom contains whitespace"]),
+            ),
+            (
+                json!({"anthropic": format!("{} ", long)}),
+                names(&["api_keys.anthropic contains whitespace"]),
+            ),
+        ];
+        for (keys, want) in cases {
+            let keys_text = keys.to_string();
+            let cfg: Config = serde_json::from_value(json!({ "api_keys": keys })).unwrap();
+            assert_eq!(validate(&cfg), want, "api_keys {}", keys_text);
+        }
+    }
+
+    #[test]
+    fn reset_all_keeps_keys_profiles_and_templates() {
+        let path = env::temp_dir().join(format!("aiterm-reset-{}.toml", std::process::id()));
+        fs::write(
+            &path,
+            "model = \"gpt-4o\"\nshow_spinner = false\n\n\
+             [api_keys]\nopenai = \"sk-0123456789abcdef\"\n\n\
+             [profiles.work]\nmodel = \"claude\"\n\n\
+             [templates]\nscript = \"write {{.Task}}\"\n",
+        )
+        .unwrap();
+        let explicit = path.to_string_lossy().into_owned();
+
+        let removed = reset(Some(&explicit), None, |_| Ok(true)).unwrap().unwrap();
+        let removed: Vec<&str> = removed.iter().map(|(key, _)| key.as_str()).collect();
+        assert_eq!(removed, ["model", "show_spinner"]);
+
+        let cfg: Config = parse_file(&path).unwrap();
+        assert_eq!(cfg.model, None);
+        assert_eq!(cfg.show_spinner, None);
+        assert_eq!(cfg.api_keys.openai.as_deref(), Some("sk-0123456789abcdef"));
+        assert_eq!(cfg.profiles["work"], json!({"model": "claude"}));
+        assert_eq!(cfg.templates["script"], "write {{.Task}}");
+        fs::remove_file(&path).unwrap();
+    }
+}
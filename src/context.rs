@@ -0,0 +1,477 @@
+// extra context gathered locally and sent along with prompts
+use crate::config::expand_path;
+use crate::history::{self, HistoryEntry};
+use crate::vendors::Image;
+use anyhow::{Context, Result, anyhow};
+use std::env;
+use std::fs;
+use std::path::Path;
+use std::process::Command;
+
+pub const DEFAULT_MAX_CAPTURE_BYTES: usize = 8 * 1024;
+pub const DEFAULT_MAX_CONTEXT_BYTES: usize = 64 * 1024;
+pub const SCRIPT_SHELLS: &[&str] = &["bash", "zsh", "fish", "sh"];
+pub const DEFAULT_SYSTEM_CONTEXT_TOOLS: &[&str] = &[
+    "brew", "apt", "dnf", "pacman", "docker", "kubectl", "git", "python3", "node",
+];
+
+// runs through `sh -c`; a failing command is still useful context
+pub fn capture_command(command: &str, working_dir: &Path, max_bytes: usize) -> Result<String> {
+    let output = Command::new("sh")
+        .arg("-c")
+        .arg(command)
+        .current_dir(working_dir)
+        .output()
+        .with_context(|| format!("Failed to run command: {}", command))?;
+
+    let mut text = String::from_utf8_lossy(&output.stdout).into_owned();
+    text.push_str(&String::from_utf8_lossy(&output.stderr));
+    Ok(truncate(text, max_bytes))
+}
+
+fn truncate(mut text: String, max_bytes: usize) -> String {
+    if text.len() <= max_bytes {
+        return text;
+    }
+    let mut end = max_bytes;
+    while !text.is_char_boundary(end) {
+        end -= 1;
+    }
+    text.truncate(end);
+    text.push_str("\n[output truncated]");
+    text
+}
+
+// `explain @Makefile` inlines the file. A word that looks like a path must
+// name a file, so a typo is an error rather than a broken prompt; any other
+// `@word` (`@{u}`, `@team`, `@property`) is left as typed, and `@@word`
+// sends a literal `@word`
+pub fn resolve_file_references(prompt: &str, base_dir: &Path, max_bytes: usize) -> Result<String> {
+    collect_file_references(prompt, base_dir, max_bytes).map(|(prompt, _)| prompt)
+}
+
+// the same, also returning each inlined file as `context` lists it
+pub fn collect_file_references(
+    prompt: &str,
+    base_dir: &Path,
+    max_bytes: usize,
+) -> Result<(String, Vec<ContextPiece>)> {
+    let mut injected = 0;
+    let mut words = Vec::new();
+    let mut pieces = Vec::new();
+    for word in prompt.split(' ') {
+        if let Some(escaped) = word.strip_prefix("@@") {
+            words.push(format!("@{}", escaped));
+            continue;
+        }
+        let Some(file) = word.strip_prefix('@').filter(|f| !f.is_empty()) else {
+            words.push(word.to_string());
+            continue;
+        };
+        let path_like = looks_like_path(file);
+        // an absolute (or ~ / $VAR) path replaces base_dir entirely
+        let path = match expand_path(file) {
+            Ok(path) => base_dir.join(path),
+            Err(e) if path_like => return Err(e),
+            Err(_) => {
+                words.push(word.to_string());
+                continue;
+            }
+        };
+        if !path_like && !path.is_file() {
+            words.push(word.to_string());
+            continue;
+        }
+        let content = fs::read_to_string(&path)
+            .with_context(|| format!("Failed to read referenced file: {:?}", path))?;
+        injected += content.len();
+        if injected > max_bytes {
+            return Err(anyhow!(
+                "Referenced files exceed max_context_bytes ({} bytes)",
+                max_bytes
+            ));
+        }
+        let block = format!("\n```\n{}\n```\n", content.trim_end());
+        pieces.push(ContextPiece {
+            label: word.to_string(),
+            content: block.clone(),
+        });
+        words.push(block);
+    }
+    Ok((words.join(" "), pieces))
+}
+
+// a directory part, a home or variable prefix, or a file extension
+fn looks_like_path(word: &str) -> bool {
+    if word.contains('/') || word.starts_with('~') || word.starts_with('$') {
+        return true;
+    }
+    match word.rsplit_once('.') {
+        Some((stem, ext)) => {
+            // "@1.2" is a version, not a file
+            !stem.is_empty()
+                && ext.chars().all(|c| c.is_ascii_alphanumeric())
+                && ext.chars().any(|c| c.is_ascii_alphabetic())
+        }
+        None => false,
+    }
+}
+
+// gemini's cap on inline data per request
+pub const MAX_IMAGE_BYTES: usize = 20 * 1024 * 1024;
+
+// `what is in @image:shot.png` attaches the file and drops the word from the text
+pub fn resolve_image_references(prompt: &str, base_dir: &Path) -> Result<(String, Vec<Image>)> {
+    let mut images = Vec::new();
+    let mut total = 0;
+    let mut words = Vec::new();
+    for word in prompt.split(' ') {
+        let Some(file) = word.strip_prefix("@image:").filter(|f| !f.is_empty()) else {
+            words.push(word);
+            continue;
+        };
+        let path = base_dir.join(expand_path(file)?);
+        let extension = path
+            .extension()
+            .and_then(|ext| ext.to_str())
+            .map(str::to_ascii_lowercase);
+        let mime_type = match extension.as_deref() {
+            Some("png") => "image/png",
+            Some("jpg") | Some("jpeg") => "image/jpeg",
+            Some("webp") => "image/webp",
+            Some("heic") => "image/heic",
+            Some("heif") => "image/heif",
+            _ => {
+                return Err(anyhow!(
+                    "Unsupported image type: {:?} (use png, jpeg, webp, heic or heif)",
+                    path
+                ));
+            }
+        };
+        let data = fs::read(&path).with_context(|| format!("Failed to read image: {:?}", path))?;
+        total += data.len();
+        if total > MAX_IMAGE_BYTES {
+            return Err(anyhow!(
+                "Images exceed {} MB per prompt",
+                MAX_IMAGE_BYTES / (1024 * 1024)
+            ));
+        }
+        images.push(Image {
+            mime_type: mime_type.to_string(),
+            data,
+        });
+    }
+    Ok((words.join(" "), images))
+}
+
+// something that will go out with the next prompt
+pub struct ContextPiece {
+    pub label: String,
+    pub content: String,
+}
+
+// history is shown one line per message but counted in full
+pub struct ContextSummary {
+    pub sections: Vec<(String, String, usize)>,
+    pub total_tokens: usize,
+}
+
+// about four characters a token for English text, which is close enough to
+// tell when a prompt is getting big
+pub fn estimate_tokens(text: &str) -> usize {
+    text.chars().count().div_ceil(4)
+}
+
+pub fn summary(
+    system_prompt: &str,
+    history: &[HistoryEntry],
+    pending: Vec<ContextPiece>,
+) -> Result<ContextSummary> {
+    let mut sections = vec![(
+        "System prompt".to_string(),
+        system_prompt.to_string(),
+        estimate_tokens(system_prompt),
+    )];
+    if !history.is_empty() {
+        let mut shown = Vec::new();
+        history::print(history, None, &mut shown, None)?;
+        sections.push((
+            format!("History, {} turns", history::turns(history)),
+            String::from_utf8_lossy(&shown).into_owned(),
+            history.iter().map(|e| estimate_tokens(&e.content)).sum(),
+        ));
+    }
+    for piece in pending {
+        let tokens = estimate_tokens(&piece.content);
+        sections.push((piece.label, piece.content, tokens));
+    }
+    let total_tokens = sections.iter().map(|(_, _, tokens)| tokens).sum();
+    Ok(ContextSummary {
+        sections,
+        total_tokens,
+    })
+}
+
+impl ContextSummary {
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        for (label, shown, tokens) in &self.sections {
+            out.push_str(&format!("== {} (~{} tokens) ==\n", label, tokens));
+            out.push_str(shown.trim_end());
+            out.push_str("\n\n");
+        }
+        out.push_str(&format!("Estimated total: ~{} tokens\n", self.total_tokens));
+        out
+    }
+}
+
+// None outside a git repo (or without git), so callers can just skip it.
+// A big checkout can list thousands of changed files, so the status is capped
+pub fn build_git_context(dir: &Path, max_bytes: usize) -> Option<String> {
+    let branch = git(dir, &["rev-parse", "--abbrev-ref", "HEAD"])?;
+    let last_commit = git(dir, &["log", "-1", "--pretty=%s"]).unwrap_or_default();
+    let status = truncate(
+        git(dir, &["status", "--short"]).unwrap_or_default(),
+        max_bytes,
+    );
+
+    let mut context = format!("GIT CONTEXT:\nBranch: {}\n", branch);
+    if !last_commit.is_empty() {
+        context.push_str(&format!("Last commit: {}\n", last_commit));
+    }
+    if status.is_empty() {
+        context.push_str("Working tree clean\n");
+    } else {
+        context.push_str(&format!("Status:\n{}\n", status));
+    }
+    Some(context)
+}
+
+fn git(dir: &Path, args: &[&str]) -> Option<String> {
+    let output = Command::new("git")
+        .args(args)
+        .current_dir(dir)
+        .output()
+        .ok()?;
+    output
+        .status
+        .success()
+        .then(|| String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+// what the model should know about the machine it is writing commands for
+pub struct SystemContext {
+    pub os: &'static str,
+    pub arch: &'static str,
+    pub shell: Option<String>,
+    // what generated scripts should be written for
+    pub script_shell: String,
+    pub tools: Vec<String>,
+    pub filesystem: Option<String>,
+    pub git: Option<String>,
+}
+
+impl SystemContext {
+    // tools are the candidates; only those found on PATH are kept
+    pub fn gather(
+        tools: &[String],
+        script_shell: &str,
+        dir: &Path,
+        with_git: bool,
+        max_git_bytes: usize,
+    ) -> Self {
+        Self {
+            os: env::consts::OS,
+            arch: env::consts::ARCH,
+            shell: env::var("SHELL").ok(),
+            script_shell: script_shell.to_string(),
+            tools: tools.iter().filter(|tool| on_path(tool)).cloned().collect(),
+            filesystem: filesystem_type(dir),
+            git: if with_git {
+                build_git_context(dir, max_git_bytes)
+            } else {
+                None
+            },
+        }
+    }
+
+    pub fn render(&self) -> String {
+        let mut context = format!("SYSTEM CONTEXT:\nOS: {}\nArch: {}\n", self.os, self.arch);
+        if let Some(shell) = &self.shell {
+            context.push_str(&format!("Shell: {}\n", shell));
+        }
+        context.push_str(&format!(
+            "Write scripts for: {} (shebang {})\n",
+            self.script_shell,
+            shebang(&self.script_shell)
+        ));
+        if !self.tools.is_empty() {
+            context.push_str(&format!("Installed tools: {}\n", self.tools.join(", ")));
+        }
+        if let Some(fs_type) = &self.filesystem {
+            context.push_str(&format!("Filesystem: {}\n", fs_type));
+        }
+        if let Some(git) = &self.git {
+            context.push('\n');
+            context.push_str(git);
+        }
+        context
+    }
+}
+
+// the login shell's name if it's one we know how to ask for, else bash
+pub fn detect_shell() -> String {
+    env::var("SHELL")
+        .ok()
+        .and_then(|path| {
+            let name = Path::new(&path).file_name()?.to_str()?.to_string();
+            SCRIPT_SHELLS.contains(&name.as_str()).then_some(name)
+        })
+        .unwrap_or_else(|| "bash".to_string())
+}
+
+pub fn shebang(shell: &str) -> &'static str {
+    match shell {
+        "zsh" => "#!/bin/zsh",
+        "fish" => "#!/usr/bin/env fish",
+        "sh" => "#!/bin/sh",
+        _ => "#!/usr/bin/env bash",
+    }
+}
+
+fn on_path(tool: &str) -> bool {
+    env::var_os("PATH")
+        .map(|paths| env::split_paths(&paths).any(|dir| dir.join(tool).is_file()))
+        .unwrap_or(false)
+}
+
+// longest mount point containing dir; only linux exposes this cheaply
+fn filesystem_type(dir: &Path) -> Option<String> {
+    let mounts = fs::read_to_string("/proc/mounts").ok()?;
+    mounts
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.split_whitespace();
+            let mount_point = fields.nth(1)?;
+            let fs_type = fields.next()?;
+            dir.starts_with(mount_point)
+                .then(|| (mount_point.len(), fs_type.to_string()))
+        })
+        .max_by_key(|(len, _)| *len)
+        .map(|(_, fs_type)| fs_type)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    fn scratch_dir(name: &str) -> PathBuf {
+        let dir = env::temp_dir().join(format!("aiterm-{}-{}", name, std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    #[test]
+    fn file_references() {
+        let dir = scratch_dir("file-references");
+        fs::write(dir.join("Makefile"), "all:\n\techo hi\n").unwrap();
+        fs::write(dir.join("property"), "not a decorator\n").unwrap();
+        let cases = [
+            ("explain @Makefile", "explain \n```\nall:\n\techo hi\n```\n"),
+            ("what does @{u} mean in git", "what does @{u} mean in git"),
+            ("email @team about it", "email @team about it"),
+            ("bump to @1.2", "bump to @1.2"),
+            ("what is @@property", "what is @property"),
+            ("escaped @@Makefile", "escaped @Makefile"),
+            ("read @property", "read \n```\nnot a decorator\n```\n"),
+            ("a lone @ sign", "a lone @ sign"),
+            ("no references", "no references"),
+        ];
+        for (prompt, want) in cases {
+            let got = resolve_file_references(prompt, &dir, DEFAULT_MAX_CONTEXT_BYTES).unwrap();
+            assert_eq!(got, want, "prompt {:?}", prompt);
+        }
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn file_reference_pieces() {
+        let dir = scratch_dir("file-reference-pieces");
+        fs::write(dir.join("a.txt"), "first\n").unwrap();
+        fs::write(dir.join("property"), "second").unwrap();
+        let prompt = "compare @a.txt with @property, @@a.txt, @team and @{u}";
+        let (expanded, pieces) =
+            collect_file_references(prompt, &dir, DEFAULT_MAX_CONTEXT_BYTES).unwrap();
+        let labels: Vec<&str> = pieces.iter().map(|p| p.label.as_str()).collect();
+        assert_eq!(labels, ["@a.txt"]);
+        assert_eq!(pieces[0].content, "\n```\nfirst\n```\n");
+        assert!(expanded.contains(&pieces[0].content));
+
+        let (_, pieces) =
+            collect_file_references("read @property", &dir, DEFAULT_MAX_CONTEXT_BYTES).unwrap();
+        assert_eq!(pieces[0].label, "@property");
+        assert!(collect_file_references("read @property", &dir, 3).is_err());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn file_references_errors() {
+        let dir = scratch_dir("file-references-errors");
+        fs::write(dir.join("big.txt"), "x".repeat(100)).unwrap();
+        let cases = [
+            ("explain @missing.rs", usize::MAX),
+            ("explain @src/missing", usize::MAX),
+            ("explain @$AITERM_TEST_UNSET_VAR/x", usize::MAX),
+            ("explain @big.txt", 10),
+        ];
+        for (prompt, max_bytes) in cases {
+            assert!(
+                resolve_file_references(prompt, &dir, max_bytes).is_err(),
+                "prompt {:?}",
+                prompt
+            );
+        }
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn git_status_truncated() {
+        let dir = scratch_dir("git-status");
+        let git_ok = |args: &[&str]| {
+            Command::new("git")
+                .args(args)
+                .current_dir(&dir)
+                .status()
+                .is_ok_and(|status| status.success())
+        };
+        // nothing to check without git
+        if !git_ok(&["init", "-q"]) {
+            return;
+        }
+        let identity = [
+            "-c",
+            "user.name=aiterm",
+            "-c",
+            "user.email=aiterm@localhost",
+        ];
+        assert!(git_ok(
+            &[
+                &identity[..],
+                &["commit", "-q", "--allow-empty", "-m", "init"]
+            ]
+            .concat()
+        ));
+        for i in 0..200 {
+            fs::write(dir.join(format!("untracked-{}.txt", i)), "").unwrap();
+        }
+        let full = build_git_context(&dir, usize::MAX).unwrap();
+        assert!(full.contains("untracked-199.txt"));
+        assert!(!full.contains("[output truncated]"));
+
+        let capped = build_git_context(&dir, 100).unwrap();
+        assert!(capped.contains("[output truncated]"));
+        assert!(capped.len() < 300, "{} bytes", capped.len());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,66 @@
+// `aiterm generate <kind>`: a prompt pinned to one kind of file
+use crate::pager;
+use anyhow::{Result, anyhow};
+
+pub struct Generator {
+    pub kind: &'static str,
+    // put before the description
+    pub instruction: &'static str,
+    // where --save writes the result by default
+    pub file_name: &'static str,
+}
+
+pub const GENERATORS: &[Generator] = &[
+    Generator {
+        kind: "dockerfile",
+        instruction: "Generate only a valid Dockerfile, in one code block, with no explanation.",
+        file_name: "Dockerfile",
+    },
+    Generator {
+        kind: "github-action",
+        instruction: "Generate only a valid GitHub Actions workflow YAML file, in one code block, with no explanation.",
+        file_name: ".github/workflows/generated.yml",
+    },
+    Generator {
+        kind: "cron",
+        instruction: "Generate only valid crontab lines, each with a comment above it saying when it runs, in one code block, with no other explanation.",
+        file_name: "crontab",
+    },
+    Generator {
+        kind: "makefile",
+        instruction: "Generate only a valid Makefile, indented with tabs, in one code block, with no explanation.",
+        file_name: "Makefile",
+    },
+];
+
+pub fn kinds() -> Vec<&'static str> {
+    GENERATORS.iter().map(|g| g.kind).collect()
+}
+
+pub fn find(kind: &str) -> Result<&'static Generator> {
+    GENERATORS
+        .iter()
+        .find(|g| g.kind == kind)
+        .ok_or_else(|| anyhow!("Unknown kind '{}'; use one of {}", kind, kinds().join(", ")))
+}
+
+pub fn prompt(generator: &Generator, description: &str) -> String {
+    format!(
+        "{}\n\nWhat it should do: {}",
+        generator.instruction, description
+    )
+}
+
+// the inside of the first fenced block, without the fences
+pub fn first_code_block(response: &str) -> Option<String> {
+    let (_, blocks) = pager::split_code_blocks(response);
+    let block = blocks.into_iter().next()?;
+    let lines: Vec<&str> = block.lines().collect();
+    let end = match lines.last() {
+        Some(last) if lines.len() > 1 && last.trim_start().starts_with("```") => lines.len() - 1,
+        _ => lines.len(),
+    };
+    let mut code = lines[1..end].join("\n");
+    code.push('\n');
+    Some(code)
+}
@@ -0,0 +1,393 @@
+use crate::ui;
+use crate::vendors::{LanguageModel, Message};
+use anyhow::{Context, Result, anyhow};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::Path;
+
+// One side of an exchange. Stored as NDJSON so saving is a cheap append.
+#[derive(Serialize, Deserialize, Debug, Clone)]
+pub struct HistoryEntry {
+    pub role: String,
+    pub content: String,
+    pub timestamp: DateTime<Utc>,
+    pub model: String,
+    #[serde(default)]
+    pub persona: String,
+}
+
+impl HistoryEntry {
+    pub fn new(role: &str, content: &str, persona: &str, model: &str) -> Self {
+        Self {
+            role: role.to_string(),
+            content: content.to_string(),
+            timestamp: Utc::now(),
+            model: model.to_string(),
+            persona: persona.to_string(),
+        }
+    }
+}
+
+pub fn load(path: &Path) -> Result<Vec<HistoryEntry>> {
+    if !path.exists() {
+        return Ok(vec![]);
+    }
+    let file_content = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read history file: {:?}", path))?;
+
+    let mut entries = Vec::new();
+    for (i, line) in file_content.lines().enumerate() {
+        if line.trim().is_empty() {
+            continue;
+        }
+        let entry: HistoryEntry = serde_json::from_str(line)
+            .with_context(|| format!("Failed to parse history line {}: {:?}", i + 1, path))?;
+        entries.push(entry);
+    }
+    Ok(entries)
+}
+
+pub fn append(path: &Path, entries: &[HistoryEntry]) -> Result<()> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create history dir: {:?}", parent))?;
+    }
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)
+        .with_context(|| format!("Failed to open history file: {:?}", path))?;
+
+    for entry in entries {
+        writeln!(file, "{}", serde_json::to_string(entry)?)
+            .with_context(|| format!("Failed to write history file: {:?}", path))?;
+    }
+    Ok(())
+}
+
+// replaces the file's contents instead of adding to them
+pub fn save(path: &Path, entries: &[HistoryEntry]) -> Result<()> {
+    if path.exists() {
+        fs::remove_file(path)
+            .with_context(|| format!("Failed to replace history file: {:?}", path))?;
+    }
+    append(path, entries)
+}
+
+// everything before the last user message, and any `context add` notes
+// after it
+pub fn remove_last_turn(entries: &[HistoryEntry]) -> Vec<HistoryEntry> {
+    let end = entries.iter().rposition(|e| e.role == "user").unwrap_or(0);
+    let mut kept = entries[..end].to_vec();
+    kept.extend(entries[end..].iter().filter(|e| is_context(e)).cloned());
+    kept
+}
+
+// `context add` notes are "system" entries too, marked so they can be told
+// apart from a summary
+pub const CONTEXT_PREFIX: &str = "[Context] ";
+
+pub fn context_note(text: &str) -> HistoryEntry {
+    HistoryEntry::new("system", &format!("{}{}", CONTEXT_PREFIX, text), "", "")
+}
+
+pub fn is_context(entry: &HistoryEntry) -> bool {
+    entry.role == "system" && entry.content.starts_with(CONTEXT_PREFIX)
+}
+
+pub fn turns(entries: &[HistoryEntry]) -> usize {
+    entries.iter().filter(|e| e.role == "user").count()
+}
+
+const SUMMARY_PROMPT: &str = "Summarize our conversation so far in 3-5 sentences for context";
+
+// the summary is stored as a "system" entry, which every vendor folds into
+// its system prompt
+pub async fn summarize(model: &dyn LanguageModel, entries: &[HistoryEntry]) -> Result<String> {
+    let mut messages: Vec<Message> = entries
+        .iter()
+        .map(|entry| Message {
+            role: entry.role.clone(),
+            content: entry.content.clone(),
+            images: vec![],
+        })
+        .collect();
+    messages.push(Message {
+        role: "user".to_string(),
+        content: SUMMARY_PROMPT.to_string(),
+        images: vec![],
+    });
+    let summary = model.ask(&messages).await.map_err(|e| anyhow!(e))?;
+    Ok(format!(
+        "Summary of the conversation so far: {}",
+        summary.trim()
+    ))
+}
+
+const PREVIEW_CHARS: usize = 80;
+
+// one line per message; a turn starts at each user message. `last` keeps
+// only the most recent turns, `page_lines` pauses after each screenful.
+pub fn print(
+    entries: &[HistoryEntry],
+    last: Option<usize>,
+    writer: &mut impl Write,
+    page_lines: Option<usize>,
+) -> Result<()> {
+    let numbered = numbered(entries);
+    let turn = numbered.last().map_or(0, |(turn, _)| *turn);
+    let first_turn = last.map_or(1, |n| (turn + 1).saturating_sub(n));
+
+    let mut printed = 0;
+    for (turn, entry) in numbered.into_iter().filter(|(t, _)| *t >= first_turn) {
+        if let Some(page) = page_lines {
+            // leave a line for the prompt itself
+            if printed > 0 && printed % page.saturating_sub(1).max(1) == 0 && !ui::wait_for_more()?
+            {
+                break;
+            }
+        }
+        let role = display_role(&entry.role);
+        let flat = flatten(&entry.content);
+        let mut preview: String = flat.chars().take(PREVIEW_CHARS).collect();
+        if flat.chars().count() > PREVIEW_CHARS {
+            preview.push_str("...");
+        }
+        writeln!(writer, "{:>4}  {:<9}  {}", turn, role, preview)?;
+        printed += 1;
+    }
+    Ok(())
+}
+
+// a turn starts at each user message
+fn numbered(entries: &[HistoryEntry]) -> Vec<(usize, &HistoryEntry)> {
+    let mut turn = 0;
+    entries
+        .iter()
+        .map(|entry| {
+            if entry.role == "user" || turn == 0 {
+                turn += 1;
+            }
+            (turn, entry)
+        })
+        .collect()
+}
+
+// the API calls it "model"; people call it the assistant
+pub fn display_role(role: &str) -> &str {
+    if role == "model" { "assistant" } else { role }
+}
+
+fn flatten(content: &str) -> String {
+    content.split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+// the match and the text either side of it, on one line
+pub struct SearchResult {
+    pub turn: usize,
+    pub role: String,
+    pub before: String,
+    pub matched: String,
+    pub after: String,
+}
+
+const SNIPPET_CONTEXT: usize = 30;
+
+// case-insensitive substring search, one result per message. When nothing
+// matches exactly, falls back to runs of words within a small edit distance
+// of the query. `role` ("user" or "assistant") narrows it to one side.
+pub fn search(entries: &[HistoryEntry], query: &str, role: Option<&str>) -> Vec<SearchResult> {
+    let query: Vec<char> = flatten(query).to_lowercase().chars().collect();
+    if query.is_empty() {
+        return vec![];
+    }
+    let mut numbered = numbered(entries);
+    if let Some(role) = role {
+        numbered.retain(|(_, entry)| display_role(&entry.role).eq_ignore_ascii_case(role));
+    }
+    let found: Vec<SearchResult> = numbered
+        .iter()
+        .filter_map(|(turn, entry)| {
+            let chars: Vec<char> = flatten(&entry.content).chars().collect();
+            find_exact(&chars, &query).map(|span| snippet(*turn, entry, &chars, span))
+        })
+        .collect();
+    if !found.is_empty() {
+        return found;
+    }
+    numbered
+        .iter()
+        .filter_map(|(turn, entry)| {
+            let chars: Vec<char> = flatten(&entry.content).chars().collect();
+            find_fuzzy(&chars, &query).map(|span| snippet(*turn, entry, &chars, span))
+        })
+        .collect()
+}
+
+fn lower(c: char) -> char {
+    c.to_lowercase().next().unwrap_or(c)
+}
+
+fn find_exact(chars: &[char], query: &[char]) -> Option<(usize, usize)> {
+    chars
+        .windows(query.len())
+        .position(|window| window.iter().zip(query).all(|(a, b)| lower(*a) == *b))
+        .map(|start| (start, start + query.len()))
+}
+
+// the closest run of as many words as the query has, if it's close enough
+fn find_fuzzy(chars: &[char], query: &[char]) -> Option<(usize, usize)> {
+    let query_words = query.split(|c| *c == ' ').count();
+    let max_distance = (query.len() / 4).max(1);
+
+    // start and end of every word; flatten() leaves single spaces
+    let mut words = Vec::new();
+    let mut start = 0;
+    for (i, c) in chars.iter().enumerate() {
+        if *c == ' ' {
+            words.push((start, i));
+            start = i + 1;
+        }
+    }
+    words.push((start, chars.len()));
+
+    let mut best: Option<(usize, (usize, usize))> = None;
+    for run in words.windows(query_words) {
+        let span = (run[0].0, run[run.len() - 1].1);
+        let text: Vec<char> = chars[span.0..span.1].iter().map(|c| lower(*c)).collect();
+        let distance = edit_distance(&text, query);
+        if distance <= max_distance && best.is_none_or(|(d, _)| distance < d) {
+            best = Some((distance, span));
+        }
+    }
+    best.map(|(_, span)| span)
+}
+
+fn edit_distance(a: &[char], b: &[char]) -> usize {
+    let mut previous: Vec<usize> = (0..=b.len()).collect();
+    for (i, ca) in a.iter().enumerate() {
+        let mut current = vec![i + 1];
+        for (j, cb) in b.iter().enumerate() {
+            let substitution = previous[j] + usize::from(ca != cb);
+            current.push(substitution.min(previous[j + 1] + 1).min(current[j] + 1));
+        }
+        previous = current;
+    }
+    previous[b.len()]
+}
+
+fn snippet(
+    turn: usize,
+    entry: &HistoryEntry,
+    chars: &[char],
+    (start, end): (usize, usize),
+) -> SearchResult {
+    let from = start.saturating_sub(SNIPPET_CONTEXT);
+    let to = (end + SNIPPET_CONTEXT).min(chars.len());
+    let mut before: String = chars[from..start].iter().collect();
+    if from > 0 {
+        before.insert_str(0, "...");
+    }
+    let mut after: String = chars[end..to].iter().collect();
+    if to < chars.len() {
+        after.push_str("...");
+    }
+    SearchResult {
+        turn,
+        role: display_role(&entry.role).to_string(),
+        before,
+        matched: chars[start..end].iter().collect(),
+        after,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chars(text: &str) -> Vec<char> {
+        text.chars().collect()
+    }
+
+    #[test]
+    fn edit_distance_cases() {
+        let cases = [
+            ("", "", 0),
+            ("abc", "", 3),
+            ("", "abc", 3),
+            ("docker", "docker", 0),
+            ("docker", "dokcer", 2),
+            ("docker", "docke", 1),
+            ("kitten", "sitting", 3),
+            ("grép", "grep", 1),
+        ];
+        for (a, b, want) in cases {
+            assert_eq!(
+                edit_distance(&chars(a), &chars(b)),
+                want,
+                "{:?} vs {:?}",
+                a,
+                b
+            );
+        }
+    }
+
+    #[test]
+    fn find_fuzzy_cases() {
+        let text = "how do I list Docker containers by size";
+        let cases = [
+            // exact and near words
+            ("docker", Some("Docker")),
+            ("dockr", Some("Docker")),
+            ("contaners", Some("containers")),
+            // as many words as the query
+            ("list dockr", Some("list Docker")),
+            ("by sise", Some("by size")),
+            // too far off
+            ("kubernetes", None),
+            ("zz", None),
+        ];
+        let text_chars = chars(text);
+        for (query, want) in cases {
+            let got = find_fuzzy(&text_chars, &chars(query))
+                .map(|(start, end)| text_chars[start..end].iter().collect::<String>());
+            assert_eq!(got.as_deref(), want, "query {:?}", query);
+        }
+    }
+
+    #[test]
+    fn remove_last_turn_cases() {
+        let entry = |role: &str, content: &str| HistoryEntry::new(role, content, "", "");
+        let cases = [
+            (vec![], vec![]),
+            (vec![entry("user", "q1"), entry("model", "a1")], vec![]),
+            (
+                vec![
+                    entry("user", "q1"),
+                    entry("model", "a1"),
+                    entry("user", "q2"),
+                    entry("model", "a2"),
+                ],
+                vec!["q1", "a1"],
+            ),
+            // notes added after the last prompt stay
+            (
+                vec![
+                    entry("user", "q1"),
+                    entry("model", "a1"),
+                    context_note("uses zsh"),
+                ],
+                vec!["[Context] uses zsh"],
+            ),
+        ];
+        for (entries, want) in cases {
+            let kept: Vec<String> = remove_last_turn(&entries)
+                .into_iter()
+                .map(|e| e.content)
+                .collect();
+            assert_eq!(kept, want);
+        }
+    }
+}
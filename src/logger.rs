@@ -0,0 +1,90 @@
+// `-v` tracing on stderr, so stdout stays just the answer; `--log-file` keeps
+// a transcript of the run
+use anyhow::{Context, Result};
+use chrono::Local;
+use std::fs::{self, File, OpenOptions};
+use std::io::Write;
+use std::path::Path;
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Instant;
+
+static VERBOSE: AtomicBool = AtomicBool::new(false);
+
+pub fn set_verbose(on: bool) {
+    VERBOSE.store(on, Ordering::Relaxed);
+}
+
+pub fn is_verbose() -> bool {
+    VERBOSE.load(Ordering::Relaxed)
+}
+
+macro_rules! verbose {
+    ($($arg:tt)*) => {
+        if $crate::logger::is_verbose() {
+            eprintln!("[aiterm] {}", format_args!($($arg)*));
+        }
+    };
+}
+pub(crate) use verbose;
+
+struct SessionLog {
+    file: File,
+    started: Instant,
+    tokens: u64,
+}
+
+static SESSION: Mutex<Option<SessionLog>> = Mutex::new(None);
+
+// appends a header to `path`; later prompts, answers and token counts go
+// after it until end_session
+pub fn start_session(path: &Path, command: &str) -> Result<()> {
+    if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+        fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create log dir: {:?}", parent))?;
+    }
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)
+        .with_context(|| format!("Failed to open log file: {:?}", path))?;
+    writeln!(
+        file,
+        "=== session started {} ===\n$ {}\n",
+        Local::now().format("%Y-%m-%d %H:%M:%S"),
+        command
+    )
+    .with_context(|| format!("Failed to write log file: {:?}", path))?;
+    *SESSION.lock().unwrap() = Some(SessionLog {
+        file,
+        started: Instant::now(),
+        tokens: 0,
+    });
+    Ok(())
+}
+
+// `who` is "user" or the model that answered; a failed write is not worth
+// stopping the run for
+pub fn log_session(who: &str, text: &str) {
+    if let Some(log) = SESSION.lock().unwrap().as_mut() {
+        let _ = writeln!(log.file, "[{}]\n{}\n", who, text.trim_end());
+    }
+}
+
+pub fn log_session_tokens(tokens: u32) {
+    if let Some(log) = SESSION.lock().unwrap().as_mut() {
+        log.tokens += u64::from(tokens);
+    }
+}
+
+pub fn end_session() {
+    if let Some(mut log) = SESSION.lock().unwrap().take() {
+        let _ = writeln!(
+            log.file,
+            "=== session ended {} ({:.1}s, {} tokens) ===\n",
+            Local::now().format("%Y-%m-%d %H:%M:%S"),
+            log.started.elapsed().as_secs_f64(),
+            log.tokens
+        );
+    }
+}
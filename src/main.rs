@@ -1,47 +1,235 @@
-use anyhow::{Result, anyhow};
+use anyhow::{Context, Result, anyhow};
+use chrono::Local;
 use clap::{Args, Parser, Subcommand};
 use std::env;
-use std::io::{self, Write};
+use std::fs::OpenOptions;
+use std::io::{self, IsTerminal, Read, Write};
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
 use tokio_stream::StreamExt;
 
+mod branch;
+mod compare;
 mod config;
+mod context;
+mod generate;
+mod history;
+mod logger;
+mod metrics;
+mod output;
+mod pager;
+mod persona;
+mod pricing;
 mod rag;
+mod ratelimit;
+mod render;
+mod session;
+mod signals;
+mod template;
+mod ui;
 mod vendors;
+mod version;
+mod watch;
 
-use crate::config::Persona;
+use crate::config::{Config, Persona};
+use crate::context::{ContextPiece, SystemContext};
+use crate::history::HistoryEntry;
+use crate::logger::verbose;
+use crate::pricing::SessionUsage;
 use crate::rag::RagStore;
+use crate::ui::{Spinner, info, warning};
+use vendors::anthropic::Anthropic;
+use vendors::azure::Azure;
+use vendors::bedrock::Bedrock;
+use vendors::cohere::Cohere;
 use vendors::gemini::Gemini;
-use vendors::{LanguageModel, Message};
+use vendors::http::{HttpClient, HttpOptions};
+use vendors::ollama::Ollama;
+use vendors::openai::OpenAi;
+use vendors::{Image, LanguageModel, Message, ResponseStream};
+
+const DEFAULT_REQUEST_TIMEOUT_SECS: u64 = 30;
+const MISTRAL_BASE_URL: &str = "https://api.mistral.ai/v1";
+const XAI_BASE_URL: &str = "https://api.x.ai/v1";
+const DEFAULT_MAX_HISTORY_TURNS: usize = 20;
 
 // CLI
 #[derive(Parser, Debug)]
-#[command(author, version, about = "Playful...🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙", long_about = None)]
+#[command(author, version, long_version = version::LONG, about = "Playful...🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙🥙", long_about = None)]
 struct Cli {
     #[command(subcommand)]
     command: Commands,
+
+    // config file to use instead of ~/.config/aiterm/config.{toml,yaml}
+    #[arg(long, global = true)]
+    config: Option<String>,
+
+    // named [profiles.<name>] table merged over the config
+    #[arg(long, global = true, env = "AITERM_PROFILE")]
+    profile: Option<String>,
+
+    // use this model instead of the persona's, e.g. "gpt-4o" or "ollama:llama3.2"
+    #[arg(short, long, global = true, env = "AITERM_MODEL")]
+    model: Option<String>,
+
+    // print only the answer: no banners, status lines or spinner
+    #[arg(
+        short,
+        long,
+        global = true,
+        env = "AITERM_QUIET",
+        conflicts_with = "verbose"
+    )]
+    quiet: bool,
+
+    // trace prompts, requests, timings and token counts on stderr
+    #[arg(short, long, global = true, env = "AITERM_VERBOSE")]
+    verbose: bool,
+
+    // append prompts, answers and token totals to this file
+    #[arg(long, global = true, env = "AITERM_LOG_FILE")]
+    log_file: Option<String>,
+
+    // print each answer, or the error, as one JSON object; implies --quiet
+    #[arg(long, global = true, env = "AITERM_JSON", conflicts_with = "verbose")]
+    json: bool,
 }
 
 #[derive(Subcommand, Debug)]
 enum Commands {
     Ask(AskArgs),
+    Explain(ExplainArgs),
     Converse(ConverseArgs),
+    History(HistoryArgs),
+    Export(ExportArgs),
+    Import(ImportArgs),
+    Compare(CompareArgs),
+    Retry(RetryArgs),
+    Context(ContextArgs),
+    Search(SearchArgs),
+    Branch(BranchArgs),
+    Checkout(BranchArgs),
+    Branches,
+    /// Read or change settings in the config file
+    Config(ConfigArgs),
+    /// Save and run prompts with {{.Name}} blanks
+    Template(TemplateArgs),
+    /// Rerun a command and ask about its output whenever it changes
+    Watch(WatchArgs),
+    /// Have the model review a script for bugs, security and style
+    Lint(LintArgs),
+    /// Write a Dockerfile, workflow, crontab or Makefile from a description
+    Generate(GenerateArgs),
+}
+
+#[derive(Args, Debug)]
+struct TemplateArgs {
+    #[command(subcommand)]
+    action: TemplateAction,
+}
+
+#[derive(Subcommand, Debug)]
+enum TemplateAction {
+    /// Save a template, e.g. `template save script "write a bash script to {{.Task}}"`
+    Save { name: String, text: String },
+    /// Fill in a template and ask it, e.g. `template run script Task="compress files"`
+    Run {
+        name: String,
+        /// Name=value for each {{.Name}} in the template
+        vars: Vec<String>,
+        #[arg(short, long, default_value = "shell", env = "AITERM_PERSONA")]
+        persona: String,
+        #[arg(long, env = "AITERM_STREAM")]
+        stream: bool,
+        #[arg(long)]
+        no_history: bool,
+    },
+    /// Show the saved templates
+    List,
+    /// Remove a saved template
+    Delete { name: String },
+}
+
+#[derive(Args, Debug)]
+struct ConfigArgs {
+    #[command(subcommand)]
+    action: ConfigAction,
+}
+
+#[derive(Subcommand, Debug)]
+enum ConfigAction {
+    /// Print one setting, e.g. `config get api_keys.openai`
+    Get { key: String },
+    /// Save one setting to the config file
+    Set { key: String, value: String },
+    /// Print every setting that has a value
+    List,
+    /// Show the settings that differ from the defaults
+    Diff,
+    /// Write a starter config with every setting documented
+    Init {
+        /// toml, yaml or json; defaults to the --config file's extension, else toml
+        #[arg(long, value_parser = ["toml", "yaml", "json"])]
+        format: Option<String>,
+        /// Overwrite an existing file without asking
+        #[arg(short, long)]
+        yes: bool,
+    },
+    /// Put one setting, or all but API keys, profiles and templates, back to its default
+    Reset {
+        key: Option<String>,
+        /// Don't ask first
+        #[arg(short, long)]
+        yes: bool,
+    },
 }
 
 #[derive(Args, Debug)]
 struct AskArgs {
-    #[arg(short, long)]
+    /// Persona file name, or a built-in: shell, python, devops, explain, minimal
+    #[arg(short, long, default_value = "shell", env = "AITERM_PERSONA")]
     persona: String,
 
-    #[arg(required = true, num_args = 1..)]
+    // may be left out when the prompt is piped on stdin
+    #[arg(num_args = 0..)]
     prompt: Vec<String>,
 
     // stream response
-    #[arg(long)]
+    #[arg(long, env = "AITERM_STREAM")]
     stream: bool,
 
     // num of context chunks to retrieve for RAG
     #[arg(long, default_value = "3")]
     rag_chunks: usize,
+
+    // neither replay nor record this exchange
+    #[arg(long, env = "AITERM_NO_HISTORY")]
+    no_history: bool,
+
+    // also write the response to this file (appends if it exists)
+    #[arg(short, long)]
+    output: Option<String>,
+
+    // run this shell command and send its output along with the prompt
+    #[arg(long)]
+    capture: Option<String>,
+}
+
+#[derive(Args, Debug)]
+struct ExplainArgs {
+    #[arg(short, long, default_value = "explain")]
+    persona: String,
+
+    // a command (a leading "$" is dropped) or a question; its flags are
+    // taken as part of it
+    #[arg(num_args = 0.., trailing_var_arg = true, allow_hyphen_values = true)]
+    prompt: Vec<String>,
+
+    #[arg(long)]
+    stream: bool,
+
+    #[arg(long)]
+    no_history: bool,
 }
 
 #[derive(Args, Debug)]
@@ -61,11 +249,174 @@ struct ConverseArgs {
     /// Num of context chunks to retrieve for RAG for each turn.
     #[arg(long, default_value = "2")]
     rag_chunks: usize,
+
+    // also write the whole conversation to this file (appends if it exists)
+    #[arg(short, long)]
+    output: Option<String>,
+}
+
+#[derive(Args, Debug)]
+struct HistoryArgs {
+    // only show the last N turns
+    last: Option<usize>,
+}
+
+#[derive(Args, Debug)]
+struct ExportArgs {
+    // defaults to aiterm-session-<timestamp>.md in the current directory
+    file: Option<String>,
+}
+
+#[derive(Args, Debug)]
+struct ImportArgs {
+    // a Markdown file written by `export`
+    file: String,
+}
+
+#[derive(Args, Debug)]
+struct CompareArgs {
+    // models to ask, comma separated: --models gpt-4o,claude-3-5-sonnet-latest,gemini
+    #[arg(long, required = true, value_delimiter = ',', num_args = 1..)]
+    models: Vec<String>,
+
+    // whose system prompt to use
+    #[arg(short, long, default_value = "shell")]
+    persona: String,
+
+    // may be left out when the prompt is piped on stdin
+    #[arg(num_args = 0..)]
+    prompt: Vec<String>,
+
+    // print the answers in columns instead of one after another
+    #[arg(long)]
+    side_by_side: bool,
+
+    // leave past exchanges out of the prompt
+    #[arg(long, env = "AITERM_NO_HISTORY")]
+    no_history: bool,
+}
+
+#[derive(Args, Debug)]
+struct RetryArgs {
+    // stream the new response
+    #[arg(long)]
+    stream: bool,
+}
+
+#[derive(Args, Debug)]
+#[command(args_conflicts_with_subcommands = true)]
+struct ContextArgs {
+    #[command(subcommand)]
+    action: Option<ContextAction>,
+
+    #[arg(short, long, default_value = "shell", env = "AITERM_PERSONA")]
+    persona: String,
+
+    // the prompt you're about to ask; only its @file references matter
+    #[arg(num_args = 0..)]
+    prompt: Vec<String>,
+
+    // include this command's output, as `ask --capture` would
+    #[arg(long)]
+    capture: Option<String>,
+}
+
+// notes kept in the history and sent with every prompt, e.g. "I'm on Ubuntu 22.04"
+#[derive(Subcommand, Debug)]
+enum ContextAction {
+    /// Add a background note for the model
+    Add {
+        #[arg(required = true, num_args = 1..)]
+        text: Vec<String>,
+    },
+    /// Show the notes
+    List,
+    /// Remove the notes, keeping the conversation
+    Clear,
+}
+
+#[derive(Args, Debug)]
+struct SearchArgs {
+    query: String,
+    /// Only search messages from "user" or "assistant"
+    #[arg(long)]
+    role: Option<String>,
+}
+
+#[derive(Args, Debug)]
+struct BranchArgs {
+    name: String,
+}
+
+#[derive(Args, Debug)]
+struct LintArgs {
+    file: String,
+
+    #[arg(short, long, default_value = "shell", env = "AITERM_PERSONA")]
+    persona: String,
+
+    /// Ask for a fixed version of the script instead of a review
+    #[arg(long)]
+    fix: bool,
+
+    #[arg(long, env = "AITERM_STREAM")]
+    stream: bool,
+
+    #[arg(long)]
+    no_history: bool,
+
+    // also write the response to this file (appends if it exists)
+    #[arg(short, long)]
+    output: Option<String>,
+}
+
+#[derive(Args, Debug)]
+struct GenerateArgs {
+    #[arg(value_parser = clap::builder::PossibleValuesParser::new(generate::kinds()))]
+    kind: String,
+
+    #[arg(required = true, num_args = 1..)]
+    description: Vec<String>,
+
+    #[arg(short, long, default_value = "shell", env = "AITERM_PERSONA")]
+    persona: String,
+
+    /// Write the generated file, to PATH or the usual name (Dockerfile, Makefile...)
+    #[arg(long, value_name = "PATH", num_args = 0..=1, default_missing_value = "")]
+    save: Option<String>,
+
+    #[arg(long, env = "AITERM_STREAM")]
+    stream: bool,
+
+    #[arg(long)]
+    no_history: bool,
+}
+
+#[derive(Args, Debug)]
+struct WatchArgs {
+    #[arg(short, long, default_value = "shell", env = "AITERM_PERSONA")]
+    persona: String,
+
+    /// Seconds between runs
+    #[arg(short, long, default_value_t = watch::DEFAULT_INTERVAL_SECS,
+          value_parser = clap::value_parser!(u64).range(1..))]
+    interval: u64,
+
+    #[arg(long, env = "AITERM_STREAM")]
+    stream: bool,
+
+    #[arg(long)]
+    no_history: bool,
+
+    // run through `sh -c`; its flags are taken as part of it
+    #[arg(required = true, num_args = 1.., trailing_var_arg = true, allow_hyphen_values = true)]
+    command: Vec<String>,
 }
 
 // Agent-}
 struct Agent {
     persona: Persona,
+    system_prompt: String,
     model: Box<dyn LanguageModel>,
     rag_store: Option<RagStore>,
 }
@@ -73,44 +424,683 @@ struct Agent {
 // main--------
 #[tokio::main]
 async fn main() -> Result<()> {
-    config::ensure_config_dir_exists()?;
     let cli = Cli::parse();
+    let json = cli.json;
+    match run(cli).await {
+        Err(e) if json => {
+            output::print_error(&e, None);
+            std::process::exit(1);
+        }
+        result => result,
+    }
+}
+
+async fn run(cli: Cli) -> Result<()> {
+    config::ensure_config_dir_exists()?;
+    signals::install();
+    logger::set_verbose(cli.verbose);
+    ui::set_quiet(cli.quiet || cli.json);
+    output::set_json(cli.json);
+    // a starter config may replace a missing or broken one, so don't load it
+    if let Commands::Config(ConfigArgs {
+        action: ConfigAction::Init { format, yes },
+    }) = &cli.command
+    {
+        return run_config_init(cli.config.as_deref(), format.as_deref(), *yes);
+    }
+    let mut cfg = match &cli.profile {
+        Some(name) => {
+            let cfg = config::load_profile(cli.config.as_deref(), name)?;
+            info!("Using profile: '{}'", name);
+            cfg
+        }
+        None => config::load_config(cli.config.as_deref())?,
+    };
+    if let Some(path) = config::find_project_config(&env::current_dir()?) {
+        cfg = config::apply_project_config(cfg, &path)?;
+        info!("Using project config: {:?}", path);
+    }
+    if cli.model.is_some() {
+        cfg.model = cli.model;
+    }
+    if cfg.tls_skip_verify.unwrap_or(false) {
+        warning!(
+            "tls_skip_verify is on; TLS certificates are NOT being checked and API keys could be intercepted."
+        );
+    }
 
-    match cli.command {
-        Commands::Ask(args) => run_ask(args).await,
-        Commands::Converse(args) => run_converse(args).await,
+    if let Some(addr) = cfg.metrics_addr.as_deref().filter(|a| !a.is_empty()) {
+        metrics::serve(addr).await?;
+        verbose!("serving metrics on {}", addr);
+    }
+    if let Some(path) = &cli.log_file {
+        let command: Vec<String> = env::args().collect();
+        logger::start_session(&config::expand_path(path)?, &command.join(" "))?;
     }
+
+    let result = match cli.command {
+        Commands::Ask(args) => run_ask(args, &cfg).await,
+        Commands::Explain(args) => run_explain(args, &cfg).await,
+        Commands::Converse(args) => run_converse(args, &cfg).await,
+        Commands::History(args) => run_history(args, &cfg),
+        Commands::Export(args) => run_export(args, &cfg),
+        Commands::Import(args) => run_import(args, &cfg),
+        Commands::Compare(args) => run_compare(args, &cfg).await,
+        Commands::Retry(args) => run_retry(args, &cfg).await,
+        Commands::Context(args) => run_context(args, &cfg),
+        Commands::Search(args) => run_search(args, &cfg),
+        Commands::Branch(args) => run_branch(args, &cfg),
+        Commands::Checkout(args) => run_checkout(args, &cfg),
+        Commands::Branches => run_branches(&cfg),
+        Commands::Config(args) => run_config(args, cli.config.as_deref(), &cfg),
+        Commands::Template(args) => run_template(args, cli.config.as_deref(), &cfg).await,
+        Commands::Watch(args) => run_watch(args, &cfg).await,
+        Commands::Lint(args) => run_lint(args, &cfg).await,
+        Commands::Generate(args) => run_generate(args, &cfg).await,
+    };
+    logger::end_session();
+    result
 }
 
-async fn run_ask(args: AskArgs) -> Result<()> {
-    let persona = config::load_persona(&args.persona)?;
-    println!(
-        "Using persona: '{}' (Model: {})",
-        persona.name, persona.model
+// the persona with any model override from --model or the config applied
+fn load_persona(name: &str, cfg: &Config) -> Result<Persona> {
+    let mut persona = config::load_persona(name)?;
+    if let Some(model) = cfg.model.as_deref().filter(|m| !m.trim().is_empty()) {
+        persona.model = model.to_string();
+    }
+    Ok(persona)
+}
+
+fn new_http_client(cfg: &Config) -> Result<HttpClient> {
+    let options = HttpOptions {
+        max_retries: cfg.max_retries,
+        connect_timeout: cfg.connect_timeout_seconds.map(Duration::from_secs),
+        proxy: cfg.http_proxy.clone().filter(|p| !p.trim().is_empty()),
+        skip_tls_verify: cfg.tls_skip_verify.unwrap_or(false),
+    };
+    HttpClient::new(&options).context("Failed to set up the HTTP client")
+}
+
+fn request_timeout(cfg: &Config) -> Duration {
+    Duration::from_secs(
+        cfg.request_timeout_seconds
+            .unwrap_or(DEFAULT_REQUEST_TIMEOUT_SECS),
+    )
+}
+
+// picks the vendor from the persona's model name
+fn new_model(persona: &Persona, cfg: &Config) -> Result<Box<dyn LanguageModel>> {
+    let http = new_http_client(cfg)?;
+    let model: Box<dyn LanguageModel> = match persona.model.as_str() {
+        "gemini" => Box::new(Gemini::new(http, cfg.get_api_key("gemini")?)),
+        m if m.starts_with("gpt") || m.starts_with("openai") => {
+            Box::new(OpenAi::new(http, cfg.get_api_key("openai")?, m))
+        }
+        m if m.starts_with("claude") => Box::new(Anthropic::new(
+            http,
+            cfg.get_api_key("anthropic")?,
+            m,
+            persona.max_tokens,
+        )),
+        // codestral is tuned for code; a shell-script persona may want its own prompt.
+        // mistral, xai and custom servers all speak the openai chat-completions protocol
+        m if m.starts_with("mistral") || m.starts_with("codestral") => Box::new(
+            OpenAi::with_base_url(http, cfg.get_api_key("mistral")?, m, MISTRAL_BASE_URL),
+        ),
+        m if m.starts_with("command") => Box::new(Cohere::new(http, cfg.get_api_key("cohere")?, m)),
+        m if m == "custom" || m.starts_with("custom:") => {
+            let base_url = cfg
+                .custom_base_url
+                .as_deref()
+                .ok_or_else(|| anyhow!("custom_base_url is not set in config.toml"))?;
+            let model = match m.strip_prefix("custom:").filter(|name| !name.is_empty()) {
+                Some(name) => name,
+                None => cfg.custom_model.as_deref().ok_or_else(|| {
+                    anyhow!("Use \"custom:<model>\" or set custom_model in config.toml")
+                })?,
+            };
+            let api_key = cfg.get_api_key("custom").unwrap_or_default();
+            Box::new(OpenAi::with_base_url(http, api_key, model, base_url))
+        }
+        m if m.starts_with("grok") => Box::new(OpenAi::with_base_url(
+            http,
+            cfg.get_api_key("xai")?,
+            m,
+            XAI_BASE_URL,
+        )),
+        m if m.starts_with("azure:") => {
+            let endpoint = cfg
+                .azure_endpoint
+                .as_deref()
+                .ok_or_else(|| anyhow!("azure_endpoint is not set in config.toml"))?;
+            let deployment = m
+                .strip_prefix("azure:")
+                .filter(|d| !d.is_empty())
+                .or(cfg.azure_deployment.as_deref())
+                .ok_or_else(|| {
+                    anyhow!("Use \"azure:<deployment>\" or set azure_deployment in config.toml")
+                })?;
+            Box::new(Azure::new(
+                http,
+                cfg.get_api_key("azure")?,
+                endpoint,
+                deployment,
+                cfg.azure_api_version.as_deref(),
+            ))
+        }
+        m if m.starts_with("bedrock:") => {
+            // the aws sdk has its own http client, which new_http_client's
+            // proxy and tls settings don't reach
+            if cfg
+                .http_proxy
+                .as_deref()
+                .is_some_and(|p| !p.trim().is_empty())
+            {
+                warning!("http_proxy is not used for bedrock; the AWS SDK connects directly");
+            }
+            if cfg.tls_skip_verify.unwrap_or(false) {
+                warning!("tls_skip_verify is not used for bedrock; certificates are still checked");
+            }
+            Box::new(
+                Bedrock::new(
+                    cfg.aws_region.as_deref(),
+                    cfg.max_retries
+                        .unwrap_or(vendors::http::DEFAULT_MAX_RETRIES),
+                    cfg.connect_timeout_seconds
+                        .map_or(vendors::http::DEFAULT_CONNECT_TIMEOUT, Duration::from_secs),
+                    m,
+                    persona.max_tokens,
+                )
+                .map_err(|e| anyhow!(e))?,
+            )
+        }
+        // keep last: vendor model ids may legitimately contain '/' or ':'.
+        // Ollama names look like "llama3.2:latest" or "library/llama3.2"; a bare
+        // "llama3.2" needs the "ollama:" prefix
+        m if m.starts_with("ollama:") || m.contains('/') || m.contains(':') => {
+            Box::new(Ollama::new(http, cfg.ollama_base_url.as_deref(), m))
+        }
+        _ => {
+            return Err(anyhow!(
+                "Unknown model '{}' in persona '{}' (for a local Ollama model, use \"ollama:{}\")",
+                persona.model,
+                persona.name,
+                persona.model
+            ));
+        }
+    };
+    // inside the rate limiter, so waiting for a slot isn't counted as request time
+    let model: Box<dyn LanguageModel> = if metrics::is_enabled() {
+        Box::new(metrics::Metered::new(model))
+    } else {
+        model
+    };
+    let (per_minute, daily_tokens) = (cfg.max_requests_per_minute, cfg.max_daily_tokens);
+    if per_minute.unwrap_or(0) == 0 && daily_tokens.unwrap_or(0) == 0 {
+        return Ok(model);
+    }
+    let limiter = ratelimit::Limiter::new(cfg.rate_limit_path()?, per_minute, daily_tokens);
+    Ok(Box::new(ratelimit::RateLimited::new(model, limiter)))
+}
+
+// embeddings always go through gemini, whatever model answers
+async fn new_rag_store(persona: &Persona, cfg: &Config) -> Result<Option<RagStore>> {
+    if persona.context_paths.is_empty() {
+        return Ok(None);
+    }
+    let api_key = cfg.get_api_key("gemini")?;
+    Ok(Some(
+        RagStore::new(new_http_client(cfg)?, api_key, &persona.context_paths).await?,
+    ))
+}
+
+fn system_context(cfg: &Config) -> Result<SystemContext> {
+    let tools = cfg.system_context_tools.clone().unwrap_or_else(|| {
+        context::DEFAULT_SYSTEM_CONTEXT_TOOLS
+            .iter()
+            .map(|tool| tool.to_string())
+            .collect()
+    });
+    let script_shell = cfg
+        .shell_preference
+        .clone()
+        .unwrap_or_else(context::detect_shell);
+    Ok(SystemContext::gather(
+        &tools,
+        &script_shell,
+        &env::current_dir()?,
+        cfg.inject_git_context.unwrap_or(true),
+        cfg.max_capture_bytes
+            .unwrap_or(context::DEFAULT_MAX_CAPTURE_BYTES),
+    ))
+}
+
+// persona prompt (or the config override), extra instructions, then local context
+fn build_system_prompt(persona: &Persona, cfg: &Config, sys_ctx: &SystemContext) -> String {
+    let mut prompt = match cfg
+        .system_prompt
+        .as_deref()
+        .filter(|p| !p.trim().is_empty())
+    {
+        Some(prompt) => prompt.to_string(),
+        None => system_prompt_file(cfg).unwrap_or_else(|| persona.system_prompt.clone()),
+    };
+    if let Some(extra) = cfg
+        .system_prompt_append
+        .as_deref()
+        .filter(|p| !p.trim().is_empty())
+    {
+        prompt.push_str("\n\n");
+        prompt.push_str(extra);
+    }
+    prompt.push_str("\n\n");
+    prompt.push_str(&sys_ctx.render());
+    prompt
+}
+
+// an unreadable or empty file falls back to the persona's prompt
+fn system_prompt_file(cfg: &Config) -> Option<String> {
+    let file = cfg
+        .system_prompt_file
+        .as_deref()
+        .filter(|f| !f.trim().is_empty())?;
+    let content = config::expand_path(file).and_then(|path| {
+        std::fs::read_to_string(&path)
+            .with_context(|| format!("Failed to read system_prompt_file: {:?}", path))
+    });
+    match content {
+        Ok(content) if !content.trim().is_empty() => Some(content.trim_end().to_string()),
+        Ok(_) => {
+            warning!(
+                "system_prompt_file {:?} is empty, using the persona's prompt",
+                file
+            );
+            None
+        }
+        Err(e) => {
+            warning!("{:#}, using the persona's prompt", e);
+            None
+        }
+    }
+}
+
+fn log_messages(messages: &[Message]) {
+    for (i, message) in messages.iter().enumerate() {
+        verbose!("message {} ({}):\n{}", i + 1, message.role, message.content);
+    }
+}
+
+// prints chunks as they arrive. Ctrl+C or SIGTERM stops the stream and
+// returns what arrived so far, with `true` to say it was cut short.
+async fn stream_response(
+    mut stream: ResponseStream,
+    timeout: Duration,
+    spinner: &mut Spinner,
+) -> Result<(String, bool)> {
+    let _responding = signals::Responding::start();
+    let interrupt = signals::interrupted();
+    tokio::pin!(interrupt);
+
+    let started = Instant::now();
+    let mut full_response = String::new();
+    loop {
+        tokio::select! {
+            chunk = within(timeout, stream.next()) => {
+                let Some(chunk) = chunk? else {
+                    verbose!("stream finished in {:?}", started.elapsed());
+                    verbose!("raw response:\n{}", full_response);
+                    return Ok((full_response, false));
+                };
+                let chunk = chunk.map_err(|e| anyhow!(e))?;
+                if full_response.is_empty() {
+                    verbose!("first token after {:?}", started.elapsed());
+                }
+                spinner.stop();
+                print!("{}", chunk);
+                io::stdout().flush()?;
+                full_response.push_str(&chunk);
+            }
+            _ = &mut interrupt => {
+                eprintln!("\n[interrupted]");
+                return Ok((full_response, true));
+            }
+        }
+    }
+}
+
+// only when someone is watching; piped output stays clean
+fn spinner(cfg: &Config) -> Spinner {
+    let tty = io::stdout().is_terminal() && io::stderr().is_terminal();
+    if !ui::is_quiet() && cfg.show_spinner.unwrap_or(tty) {
+        Spinner::start()
+    } else {
+        Spinner::disabled()
+    }
+}
+
+fn render_markdown(cfg: &Config) -> bool {
+    cfg.render_markdown
+        .unwrap_or_else(|| io::stdout().is_terminal() && env::var_os("NO_COLOR").is_none())
+}
+
+fn format_response(text: &str, cfg: &Config) -> String {
+    if render_markdown(cfg) {
+        render::markdown(text, terminal_width())
+    } else {
+        format!("{}\n", text)
+    }
+}
+
+fn use_pager(cfg: &Config) -> bool {
+    cfg.use_pager.unwrap_or(false) && io::stdout().is_terminal()
+}
+
+// the prose goes through the pager; code blocks are printed after it so they
+// stay on screen. A streamed answer is already there in full.
+fn page_response(response: &str, cfg: &Config, streamed: bool) {
+    let (prose, blocks) = pager::split_code_blocks(response);
+    let cmd = cfg.pager.as_deref().unwrap_or(pager::DEFAULT_PAGER);
+    // Ctrl+C is the pager's to handle
+    let _responding = signals::Responding::start();
+    if let Err(e) = pager::open(&format_response(&prose, cfg), cmd) {
+        warning!("Could not open the pager: {:#}", e);
+        if !streamed {
+            print!("{}", format_response(response, cfg));
+        }
+        return;
+    }
+    if !streamed {
+        for block in blocks {
+            print!("{}", format_response(&block, cfg));
+        }
+    }
+}
+
+fn terminal_width() -> usize {
+    env::var("COLUMNS")
+        .ok()
+        .and_then(|columns| columns.parse().ok())
+        .unwrap_or(80)
+}
+
+// a hung API shouldn't hang aiterm too
+async fn within<T>(timeout: Duration, future: impl Future<Output = T>) -> Result<T> {
+    tokio::time::timeout(timeout, future)
+        .await
+        .map_err(|_| anyhow!("Request timed out after {}s", timeout.as_secs()))
+}
+
+// adds the last response's tokens to the run's totals and reports them
+fn record_usage(
+    model: &dyn LanguageModel,
+    model_name: &str,
+    cfg: &Config,
+    session: &mut SessionUsage,
+) {
+    let Some(usage) = model.last_usage() else {
+        return;
+    };
+    logger::log_session_tokens(usage.total());
+    let spent_before = session.cost;
+    session.add(usage, model_name);
+
+    let cost = pricing::estimate_cost(&usage, model_name)
+        .map(|cost| format!(" cost=~${:.4}", cost))
+        .unwrap_or_default();
+    let summary = format!(
+        "tokens: prompt={} completion={} total={}{}",
+        usage.prompt,
+        usage.completion,
+        usage.total(),
+        cost
     );
+    if cfg.show_token_usage.unwrap_or(false) {
+        info!("[{}]", summary);
+    } else {
+        verbose!("{}", summary);
+    }
+    if let Some(threshold) = cfg.cost_warning_threshold_usd {
+        if spent_before < threshold && session.cost >= threshold {
+            warning!(
+                "estimated cost ${:.4} has passed the ${:.2} threshold",
+                session.cost,
+                threshold
+            );
+        }
+    }
+}
 
-    let api_key = env::var("GEMINI_API_KEY")
-        .map_err(|_| anyhow!("GEMINI_API_KEY environment variable not set."))?;
+fn print_session_usage(cfg: &Config, session: &SessionUsage) {
+    if !cfg.show_token_usage.unwrap_or(false) || session.usage.total() == 0 {
+        return;
+    }
+    info!(
+        "[session tokens: prompt={} completion={} total={} | estimated cost: ${:.4}{}]",
+        session.usage.prompt,
+        session.usage.completion,
+        session.usage.total(),
+        session.cost,
+        if session.unpriced {
+            " (some models unpriced)"
+        } else {
+            ""
+        }
+    );
+}
+
+// `git diff | aiterm ask -p x "explain this"` sends the diff along with the prompt
+fn read_prompt(prompt: String) -> Result<String> {
+    let mut piped = String::new();
+    // with a typed prompt, only a pipe or a file counts as input: under cron or
+    // ssh stdin may be left open and never closed, and a `while read` loop
+    // calling aiterm needs its stdin to itself
+    let typed = !prompt.trim().is_empty();
+    if !io::stdin().is_terminal() && (!typed || stdin_is_pipe_or_file()) {
+        io::stdin().read_to_string(&mut piped)?;
+    }
+    let piped = piped.trim();
+
+    match (prompt.trim().is_empty(), piped.is_empty()) {
+        (true, true) => Err(anyhow!(
+            "No prompt given: pass one as arguments or pipe it on stdin."
+        )),
+        (true, false) => Ok(piped.to_string()),
+        (false, true) => Ok(prompt),
+        (false, false) => Ok(format!("{}\n\n```\n{}\n```", prompt, piped)),
+    }
+}
+
+#[cfg(unix)]
+fn stdin_is_pipe_or_file() -> bool {
+    use std::os::fd::AsFd;
+    use std::os::unix::fs::FileTypeExt;
+    let Ok(fd) = io::stdin().as_fd().try_clone_to_owned() else {
+        return false;
+    };
+    std::fs::File::from(fd)
+        .metadata()
+        .is_ok_and(|m| m.file_type().is_fifo() || m.is_file())
+}
+
+#[cfg(not(unix))]
+fn stdin_is_pipe_or_file() -> bool {
+    false
+}
+
+async fn run_ask(args: AskArgs, cfg: &Config) -> Result<()> {
+    let cwd = env::current_dir()?;
+    let max_context_bytes = cfg
+        .max_context_bytes
+        .unwrap_or(context::DEFAULT_MAX_CONTEXT_BYTES);
+    // only the typed prompt: piped text may contain `@` for other reasons
+    let (typed, images) = context::resolve_image_references(&args.prompt.join(" "), &cwd)?;
+    let typed = context::resolve_file_references(&typed, &cwd, max_context_bytes)?;
+    let mut prompt_str = read_prompt(typed)?;
+    if let Some(command) = &args.capture {
+        let max_bytes = cfg
+            .max_capture_bytes
+            .unwrap_or(context::DEFAULT_MAX_CAPTURE_BYTES);
+        let output = context::capture_command(command, &cwd, max_bytes)?;
+        info!("{}", output.trim_end());
+        prompt_str = format!(
+            "The output of `{}` was:\n```\n{}\n```\n\n{}",
+            command,
+            output.trim_end(),
+            prompt_str
+        );
+    }
+    send_prompt(prompt_str, images, &args, cfg).await?;
+    Ok(())
+}
+
+const DEFAULT_EXPLAIN_PREFIX: &str =
+    "Explain the following in detail without generating executable commands: ";
+
+async fn run_explain(args: ExplainArgs, cfg: &Config) -> Result<()> {
+    let mut prompt = args.prompt;
+    // `explain $ ls -la` explains `ls -la`
+    if let Some(first) = prompt.first_mut() {
+        if first == "$" {
+            prompt.remove(0);
+        } else if let Some(rest) = first.strip_prefix('$') {
+            *first = rest.to_string();
+        }
+    }
+    let prefix = cfg
+        .explain_prefix
+        .as_deref()
+        .unwrap_or(DEFAULT_EXPLAIN_PREFIX);
+    prompt.insert(0, prefix.trim_end().to_string());
+
+    let ask = AskArgs {
+        persona: args.persona,
+        prompt,
+        stream: args.stream,
+        rag_chunks: 3,
+        no_history: args.no_history,
+        output: None,
+        capture: None,
+    };
+    run_ask(ask, cfg).await
+}
+
+const LINT_PROMPT: &str = "Review this script for bugs, security issues, and style problems. \
+List each issue with its line number. Answer in plain text only: no code blocks.";
+const LINT_FIX_PROMPT: &str = "Fix the bugs, security issues, and style problems in this script. \
+Reply with the whole fixed script in one code block, then list what changed.";
+
+async fn run_lint(args: LintArgs, cfg: &Config) -> Result<()> {
+    let path = config::expand_path(&args.file)?;
+    let script = std::fs::read_to_string(&path)
+        .with_context(|| format!("Failed to read script: {:?}", path))?;
+    let max_bytes = cfg
+        .max_context_bytes
+        .unwrap_or(context::DEFAULT_MAX_CONTEXT_BYTES);
+    if script.len() > max_bytes {
+        return Err(anyhow!(
+            "{:?} is larger than max_context_bytes ({} bytes)",
+            path,
+            max_bytes
+        ));
+    }
 
-    let rag_store = if !persona.context_paths.is_empty() {
-        Some(RagStore::new(api_key.clone(), &persona.context_paths).await?)
+    // numbered so "line 12" in the review means line 12 of the file
+    let numbered: Vec<String> = script
+        .lines()
+        .enumerate()
+        .map(|(i, line)| format!("{:>4}  {}", i + 1, line))
+        .collect();
+    let (instruction, body) = if args.fix {
+        (LINT_FIX_PROMPT, script.trim_end().to_string())
     } else {
-        None
+        (LINT_PROMPT, numbered.join("\n"))
     };
+    let prompt = format!("{}\n\n{}:\n```\n{}\n```", instruction, args.file, body);
 
-    let model: Box<dyn LanguageModel> = match persona.model.as_str() {
-        "gemini" => Box::new(Gemini::new(api_key)),
-        _ => return Err(anyhow!("Unknown model '{}'", persona.model)),
+    let ask = AskArgs {
+        persona: args.persona,
+        prompt: vec![],
+        stream: args.stream,
+        rag_chunks: 3,
+        no_history: args.no_history,
+        output: args.output,
+        capture: None,
+    };
+    send_prompt(prompt, vec![], &ask, cfg).await?;
+    if !args.fix {
+        info!("\nFor a fixed version: aiterm lint --fix {}", args.file);
+    }
+    Ok(())
+}
+
+async fn run_generate(args: GenerateArgs, cfg: &Config) -> Result<()> {
+    let generator = generate::find(&args.kind)?;
+    // checked first, so a clash doesn't cost a request
+    let save_path = match args.save.as_deref() {
+        None => None,
+        Some("") => Some(PathBuf::from(generator.file_name)),
+        Some(path) => Some(config::expand_path(path)?),
+    };
+    if let Some(path) = save_path.as_ref().filter(|p| p.exists()) {
+        return Err(anyhow!("{:?} already exists; not overwriting it", path));
+    }
+
+    let prompt = generate::prompt(generator, &args.description.join(" "));
+    let ask = AskArgs {
+        persona: args.persona,
+        prompt: vec![],
+        stream: args.stream,
+        rag_chunks: 3,
+        no_history: args.no_history,
+        output: None,
+        capture: None,
     };
+    let response = send_prompt(prompt, vec![], &ask, cfg).await?;
+    let (Some(response), Some(path)) = (response, save_path) else {
+        return Ok(());
+    };
+
+    let code = generate::first_code_block(&response)
+        .ok_or_else(|| anyhow!("The response has no code block to save"))?;
+    if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+        std::fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create directory: {:?}", parent))?;
+    }
+    std::fs::write(&path, code).with_context(|| format!("Failed to write {:?}", path))?;
+    info!("Saved {:?}", path);
+    Ok(())
+}
 
-    let prompt_str = args.prompt.join(" ");
-    println!("\nAsking: {}...", prompt_str);
+// everything after the prompt is assembled; shared with retry. Returns the
+// answer, or None when Ctrl+C stopped it before anything arrived
+async fn send_prompt(
+    prompt_str: String,
+    images: Vec<Image>,
+    args: &AskArgs,
+    cfg: &Config,
+) -> Result<Option<String>> {
+    let persona = load_persona(&args.persona, cfg)?;
+    info!(
+        "Using persona: '{}' (Model: {})",
+        persona.name, persona.model
+    );
+
+    let rag_store = new_rag_store(&persona, cfg).await?;
+    let model = new_model(&persona, cfg)?;
+    if !images.is_empty() && !model.supports_images() {
+        return Err(anyhow!(
+            "Model '{}' does not accept images; @image: needs a gemini persona",
+            persona.model
+        ));
+    }
+
+    info!("\nAsking: {}...", prompt_str);
 
     let context_str = if let Some(store) = &rag_store {
-        println!("Searching for relevant context via API...");
+        info!("Searching for relevant context via API...");
         let context_chunks = store.search(&prompt_str, args.rag_chunks).await?;
         if !context_chunks.is_empty() {
-            println!("Found {} relevant context snippets.", context_chunks.len());
+            info!("Found {} relevant context snippets.", context_chunks.len());
             format!(
                 "Here is some relevant context from the local files:\n\n{}\n",
                 context_chunks.join("\n")
@@ -122,58 +1112,638 @@ async fn run_ask(args: AskArgs) -> Result<()> {
         String::new()
     };
 
-    let final_content = format!(
-        "{}\n\n{}\n\nUser question: {}",
-        persona.system_prompt, context_str, prompt_str
-    );
+    let final_content = format!("{}\n\nUser question: {}", context_str, prompt_str);
 
-    let messages = vec![Message {
+    let persist_history = cfg.persist_history.unwrap_or(true) && !args.no_history;
+    let history_path = cfg.history_path()?;
+    let mut past_entries = if persist_history {
+        history::load(&history_path)?
+    } else {
+        vec![]
+    };
+    let max_turns = cfg.max_history_turns.unwrap_or(DEFAULT_MAX_HISTORY_TURNS);
+    if history::turns(&past_entries) > max_turns && cfg.auto_summarize.unwrap_or(true) {
+        verbose!(
+            "history has {} turns, summarizing",
+            history::turns(&past_entries)
+        );
+        match within(
+            request_timeout(cfg),
+            history::summarize(model.as_ref(), &past_entries),
+        )
+        .await
+        .and_then(|summary| summary)
+        {
+            Ok(summary) => {
+                // notes from `context add` outlive the summary
+                past_entries.retain(history::is_context);
+                past_entries.push(HistoryEntry::new(
+                    "system",
+                    &summary,
+                    &args.persona,
+                    &persona.model,
+                ));
+                history::save(&history_path, &past_entries)?;
+                info!("[History summarized]");
+            }
+            // not fatal: the question can still go out with the full history
+            Err(e) => warning!("Could not summarize history: {}", e),
+        }
+    }
+
+    let mut messages = vec![Message {
+        role: "system".to_string(),
+        content: build_system_prompt(&persona, cfg, &system_context(cfg)?),
+        images: vec![],
+    }];
+    messages.extend(past_entries.iter().map(|entry| Message {
+        role: entry.role.clone(),
+        content: entry.content.clone(),
+        images: vec![],
+    }));
+    messages.push(Message {
         role: "user".to_string(),
         content: final_content,
-    }];
+        images,
+    });
 
-    if args.stream {
-        println!("\n--- Response Stream ---");
-        let mut response_stream = model.ask_stream(&messages).await.map_err(|e| anyhow!(e))?;
-        while let Some(chunk_result) = response_stream.next().await {
-            let chunk = chunk_result.map_err(|e| anyhow!(e))?;
-            print!("{}", chunk);
-            io::stdout().flush()?;
-        }
+    log_messages(&messages);
+    let timeout = request_timeout(cfg);
+    // --json buffers the answer and prints it whole
+    let response = if args.stream && !output::is_json() {
+        info!("\n--- Response Stream ---");
+        let mut spinner = spinner(cfg);
+        let response_stream = within(timeout, model.ask_stream(&messages))
+            .await?
+            .map_err(|e| anyhow!(e))?;
+        let (full_response, _) = stream_response(response_stream, timeout, &mut spinner).await?;
         println!();
+        if use_pager(cfg) {
+            page_response(&full_response, cfg, true);
+        }
+        full_response
     } else {
-        let response = model.ask(&messages).await.map_err(|e| anyhow!(e))?;
-        println!("\n--- Response ---\n{}", response);
+        // nothing has been shown yet, so an interrupt leaves nothing to keep
+        let _responding = signals::Responding::start();
+        let mut spinner = spinner(cfg);
+        let started = Instant::now();
+        tokio::select! {
+            response = within(timeout, model.ask(&messages)) => {
+                spinner.stop();
+                let response = response?.map_err(|e| anyhow!(e))?;
+                verbose!("response in {:?}", started.elapsed());
+                verbose!("raw response:\n{}", response);
+                info!("\n--- Response ---");
+                if output::is_json() {
+                    // printed once the exchange is recorded
+                } else if use_pager(cfg) {
+                    page_response(&response, cfg, false);
+                } else {
+                    print!("{}", format_response(&response, cfg));
+                }
+                response
+            }
+            _ = signals::interrupted() => {
+                eprintln!("\n[interrupted]");
+                signals::exit_if_shutting_down();
+                return Ok(None);
+            }
+        }
+    };
+    logger::log_session("user", &prompt_str);
+    logger::log_session(&persona.model, &response);
+    record_usage(
+        model.as_ref(),
+        &persona.model,
+        cfg,
+        &mut SessionUsage::default(),
+    );
+
+    if let Some(path) = &args.output {
+        save_response(path, &response)?;
     }
 
-    Ok(())
+    if persist_history {
+        history::append(
+            &history_path,
+            &[
+                HistoryEntry::new("user", &prompt_str, &args.persona, &persona.model),
+                HistoryEntry::new("model", &response, &args.persona, &persona.model),
+            ],
+        )?;
+    }
+    if output::is_json() {
+        output::print_exchange(
+            history::turns(&past_entries) + 1,
+            &persona.model,
+            &response,
+            model.last_usage(),
+        );
+    }
+    signals::exit_if_shutting_down();
+
+    Ok(Some(response))
 }
 
-async fn run_converse(args: ConverseArgs) -> Result<()> {
-    println!("Starting a conversation with: {}", args.persona.join(", "));
-    let api_key = env::var("GEMINI_API_KEY")
-        .map_err(|_| anyhow!("GEMINI_API_KEY environment variable not set."))?;
+// drops the last exchange and asks its question again; the new answer takes
+// its place in the history
+async fn run_retry(args: RetryArgs, cfg: &Config) -> Result<()> {
+    let history_path = cfg.history_path()?;
+    let entries = history::load(&history_path)?;
+    let Some(last) = entries.iter().rfind(|e| e.role == "user") else {
+        return Err(anyhow!("Nothing to retry: the history has no prompts."));
+    };
+    let ask = AskArgs {
+        persona: if last.persona.is_empty() {
+            "shell".to_string()
+        } else {
+            last.persona.clone()
+        },
+        prompt: vec![],
+        stream: args.stream,
+        rag_chunks: 3,
+        no_history: false,
+        output: None,
+        capture: None,
+    };
+    let prompt = last.content.clone();
+
+    history::save(&history_path, &history::remove_last_turn(&entries))?;
+    // images aren't kept in the history, so only the text goes again
+    let result = send_prompt(prompt, vec![], &ask, cfg).await;
+    // an error or an interrupt records no answer (though summarizing may
+    // already have rewritten the history); put the old one back rather than
+    // lose it
+    let recorded = cfg.persist_history.unwrap_or(true) && matches!(result, Ok(Some(_)));
+    if !recorded {
+        history::save(&history_path, &entries)?;
+    }
+    result.map(|_| ())
+}
 
-    // load agents
-    let mut agents = Vec::new();
-    for p_name in &args.persona {
-        let persona = config::load_persona(p_name)?;
-        let model: Box<dyn LanguageModel> = match persona.model.as_str() {
-            "gemini" => Box::new(Gemini::new(api_key.clone())),
-            _ => {
-                return Err(anyhow!(
-                    "Unknown model '{}' in persona '{}'",
-                    persona.model,
-                    p_name
-                ));
+fn run_history(args: HistoryArgs, cfg: &Config) -> Result<()> {
+    let entries = history::load(&cfg.history_path()?)?;
+    if entries.is_empty() {
+        info!("No history yet.");
+        return Ok(());
+    }
+    history::print(&entries, args.last, &mut io::stdout(), page_lines())
+}
+
+// only pause between screens when someone is reading them
+fn page_lines() -> Option<usize> {
+    io::stdout().is_terminal().then(|| {
+        env::var("LINES")
+            .ok()
+            .and_then(|lines| lines.parse().ok())
+            .unwrap_or(24)
+    })
+}
+
+// runs until Ctrl+C; a failed ask is reported and the watch goes on
+async fn run_watch(args: WatchArgs, cfg: &Config) -> Result<()> {
+    let _session = metrics::Session::start();
+    let cwd = env::current_dir()?;
+    let command = args.command.join(" ");
+    let max_bytes = cfg
+        .max_capture_bytes
+        .unwrap_or(context::DEFAULT_MAX_CAPTURE_BYTES);
+    let ask = AskArgs {
+        persona: args.persona,
+        prompt: vec![],
+        stream: args.stream,
+        rag_chunks: 3,
+        no_history: args.no_history,
+        output: None,
+        capture: None,
+    };
+
+    let mut previous = context::capture_command(&command, &cwd, max_bytes)?;
+    info!(
+        "Watching `{}` every {}s (Ctrl+C to stop)",
+        command, args.interval
+    );
+    let mut ticker = tokio::time::interval(Duration::from_secs(args.interval));
+    // an answer can take longer than the interval; don't fire the missed ticks
+    ticker.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+    ticker.tick().await;
+    loop {
+        ticker.tick().await;
+        let output = match context::capture_command(&command, &cwd, max_bytes) {
+            Ok(output) => output,
+            Err(e) => {
+                warning!("Could not run `{}`: {:#}", command, e);
+                continue;
             }
         };
-        let rag_store = if !persona.context_paths.is_empty() {
-            Some(RagStore::new(api_key.clone(), &persona.context_paths).await?)
+        let diff = watch::diff_lines(&previous, &output);
+        previous = output;
+        if diff.is_empty() {
+            continue;
+        }
+        verbose!("watch diff:\n{}", diff);
+        info!("\n[{}] output changed", Local::now().format("%H:%M:%S"));
+        if let Err(e) = send_prompt(watch::change_prompt(&command, &diff), vec![], &ask, cfg).await
+        {
+            warning!("Could not ask about the change: {:#}", e);
+        }
+    }
+}
+
+fn run_context_notes(action: ContextAction, cfg: &Config) -> Result<()> {
+    let history_path = cfg.history_path()?;
+    let entries = history::load(&history_path)?;
+    match action {
+        ContextAction::Add { text } => {
+            if !cfg.persist_history.unwrap_or(true) {
+                warning!("persist_history is off, so notes aren't sent with prompts");
+            }
+            history::append(&history_path, &[history::context_note(&text.join(" "))])?;
+            info!("Context added.");
+        }
+        ContextAction::List => {
+            let notes: Vec<&HistoryEntry> =
+                entries.iter().filter(|e| history::is_context(e)).collect();
+            if notes.is_empty() {
+                info!("No context notes. Add one with `aiterm context add <text>`.");
+            }
+            for (i, note) in notes.iter().enumerate() {
+                let text = &note.content[history::CONTEXT_PREFIX.len()..];
+                println!("{}. {}", i + 1, text);
+            }
+        }
+        ContextAction::Clear => {
+            let (notes, kept): (Vec<_>, Vec<_>) =
+                entries.into_iter().partition(history::is_context);
+            if !notes.is_empty() {
+                history::save(&history_path, &kept)?;
+            }
+            info!("Removed {} context note(s).", notes.len());
+        }
+    }
+    Ok(())
+}
+
+// what `ask` with the same arguments would send, without sending it
+fn run_context(args: ContextArgs, cfg: &Config) -> Result<()> {
+    if let Some(action) = args.action {
+        return run_context_notes(action, cfg);
+    }
+    let persona = load_persona(&args.persona, cfg)?;
+    let system_prompt = build_system_prompt(&persona, cfg, &system_context(cfg)?);
+
+    let entries = if cfg.persist_history.unwrap_or(true) {
+        history::load(&cfg.history_path()?)?
+    } else {
+        vec![]
+    };
+
+    // resolved exactly as ask does, so escapes and non-path `@word`s match
+    let cwd = env::current_dir()?;
+    let max_context_bytes = cfg
+        .max_context_bytes
+        .unwrap_or(context::DEFAULT_MAX_CONTEXT_BYTES);
+    let (typed, _) = context::resolve_image_references(&args.prompt.join(" "), &cwd)?;
+    let (_, mut pending) = context::collect_file_references(&typed, &cwd, max_context_bytes)?;
+    if let Some(command) = &args.capture {
+        let max_bytes = cfg
+            .max_capture_bytes
+            .unwrap_or(context::DEFAULT_MAX_CAPTURE_BYTES);
+        pending.push(ContextPiece {
+            label: format!("Output of `{}`", command),
+            content: context::capture_command(command, &cwd, max_bytes)?,
+        });
+    }
+
+    let summary = context::summary(&system_prompt, &entries, pending)?;
+    ui::print_paged(&summary.render(), &mut io::stdout(), page_lines())?;
+    let max_turns = cfg.max_history_turns.unwrap_or(DEFAULT_MAX_HISTORY_TURNS);
+    if history::turns(&entries) > max_turns && cfg.auto_summarize.unwrap_or(true) {
+        info!("The history is over max_history_turns and will be summarized first.");
+    }
+    Ok(())
+}
+
+fn run_export(args: ExportArgs, cfg: &Config) -> Result<()> {
+    let entries = history::load(&cfg.history_path()?)?;
+    if entries.is_empty() {
+        info!("No history to export.");
+        return Ok(());
+    }
+    let path = PathBuf::from(args.file.unwrap_or_else(session::default_export_name));
+    session::export_markdown(&entries, &path)?;
+    info!("Exported {} messages to {:?}", entries.len(), path);
+    Ok(())
+}
+
+// appended, so the next ask picks the imported turns up as history
+fn run_import(args: ImportArgs, cfg: &Config) -> Result<()> {
+    let entries = session::import_markdown(Path::new(&args.file))?;
+    history::append(&cfg.history_path()?, &entries)?;
+    info!("Imported {} messages from {:?}", entries.len(), args.file);
+    Ok(())
+}
+
+fn run_search(args: SearchArgs, cfg: &Config) -> Result<()> {
+    let entries = history::load(&cfg.history_path()?)?;
+    let role = args.role.as_deref().map(history::display_role);
+    let results = history::search(&entries, &args.query, role);
+    if results.is_empty() {
+        info!("No matches for {:?}.", args.query);
+        return Ok(());
+    }
+    let color = io::stdout().is_terminal() && env::var_os("NO_COLOR").is_none();
+    for r in results {
+        let matched = if color {
+            format!("\x1b[1;33m{}\x1b[0m", r.matched)
         } else {
-            None
+            format!("[{}]", r.matched)
         };
+        println!(
+            "{:>4}  {:<9}  {}{}{}",
+            r.turn, r.role, r.before, matched, r.after
+        );
+    }
+    Ok(())
+}
+
+fn run_branch(args: BranchArgs, cfg: &Config) -> Result<()> {
+    if let Some(dropped) = branch::create(&cfg.history_path()?, &args.name)? {
+        info!(
+            "Removed the oldest branch '{}' (at most {} are kept)",
+            dropped,
+            branch::MAX_BRANCHES
+        );
+    }
+    info!("Saved the current history as branch '{}'", args.name);
+    Ok(())
+}
+
+// the current history is replaced; branch it first to keep it
+fn run_checkout(args: BranchArgs, cfg: &Config) -> Result<()> {
+    branch::checkout(&cfg.history_path()?, &args.name)?;
+    info!("Switched history to branch '{}'", args.name);
+    Ok(())
+}
+
+fn run_branches(cfg: &Config) -> Result<()> {
+    let branches = branch::list(&cfg.history_path()?)?;
+    if branches.is_empty() {
+        info!("No branches yet.");
+    }
+    for b in branches {
+        println!(
+            "{:<20}  {}  {} turns",
+            b.name,
+            b.created.format("%Y-%m-%d %H:%M"),
+            b.turns
+        );
+    }
+    Ok(())
+}
+
+// `cfg` is what this run uses (profile and --model applied); `set` only
+// touches the file's base settings
+fn run_config(args: ConfigArgs, explicit: Option<&str>, cfg: &Config) -> Result<()> {
+    match args.action {
+        ConfigAction::Get { key } => {
+            match config::settings(cfg)?.into_iter().find(|(k, _)| *k == key) {
+                Some((_, value)) => println!("{}", value),
+                None => info!("{} is not set", key),
+            }
+        }
+        ConfigAction::Set { key, value } => {
+            let updated = config::set(explicit, &key, &value)?;
+            let shown = config::settings(&updated)?
+                .into_iter()
+                .find(|(k, _)| *k == key)
+                .map(|(_, v)| v)
+                .unwrap_or_default();
+            info!("{} = {}", key, shown);
+        }
+        ConfigAction::List => {
+            for (key, value) in config::settings(cfg)? {
+                // keys are secrets; `config get` still prints one on request
+                if key.starts_with("api_keys.") {
+                    println!("{} = (set)", key);
+                } else {
+                    println!("{} = {}", key, value);
+                }
+            }
+        }
+        ConfigAction::Diff => {
+            let diffs = config::diff(cfg)?;
+            if diffs.is_empty() {
+                info!("Every setting is at its default.");
+            }
+            for d in diffs {
+                let value = if d.key.starts_with("api_keys.") {
+                    "(set)".to_string()
+                } else {
+                    d.value
+                };
+                match d.default {
+                    Some(default) => println!("~ {}: {} -> {}", d.key, default, value),
+                    None => println!("+ {} = {}", d.key, value),
+                }
+            }
+        }
+        // handled before the config is loaded
+        ConfigAction::Init { .. } => unreachable!(),
+        ConfigAction::Reset { key, yes } => {
+            let shown = |key: &str, value: &str| {
+                if key.starts_with("api_keys.") {
+                    "(set)".to_string()
+                } else {
+                    value.to_string()
+                }
+            };
+            let Some(removed) = config::reset(explicit, key.as_deref(), |removed| {
+                if yes {
+                    return Ok(true);
+                }
+                for (key, value) in removed {
+                    println!("  {} = {}", key, shown(key, value));
+                }
+                confirm(&format!(
+                    "Reset {} setting(s) to the default?",
+                    removed.len()
+                ))
+            })?
+            else {
+                return Ok(());
+            };
+            if removed.is_empty() {
+                info!("Nothing to reset.");
+            }
+            for (key, value) in removed {
+                info!("Reset {} (was {})", key, shown(&key, &value));
+            }
+        }
+    }
+    Ok(())
+}
+
+async fn run_template(args: TemplateArgs, explicit: Option<&str>, cfg: &Config) -> Result<()> {
+    match args.action {
+        TemplateAction::Save { name, text } => {
+            template::check_name(&name)?;
+            config::set(explicit, &format!("templates.{}", name), &text)?;
+            info!("Saved template '{}'", name);
+        }
+        TemplateAction::Run {
+            name,
+            vars,
+            persona,
+            stream,
+            no_history,
+        } => {
+            let vars = template::parse_vars(&vars)?;
+            let prompt = template::expand(&cfg.templates, &name, &vars)?;
+            let ask = AskArgs {
+                persona,
+                prompt: vec![prompt],
+                stream,
+                rag_chunks: 3,
+                no_history,
+                output: None,
+                capture: None,
+            };
+            run_ask(ask, cfg).await?;
+        }
+        TemplateAction::List => {
+            if cfg.templates.is_empty() {
+                info!("No templates saved. Add one with `aiterm template save <name> <text>`.");
+            }
+            for (name, text) in &cfg.templates {
+                println!("{}: {}", name, text);
+            }
+        }
+        TemplateAction::Delete { name } => {
+            template::check_name(&name)?;
+            let removed =
+                config::reset(explicit, Some(&format!("templates.{}", name)), |_| Ok(true))?;
+            if removed.is_none_or(|r| r.is_empty()) {
+                return Err(anyhow!("No template named '{}' in the config file", name));
+            }
+            info!("Deleted template '{}'", name);
+        }
+    }
+    Ok(())
+}
+
+fn run_config_init(explicit: Option<&str>, format: Option<&str>, yes: bool) -> Result<()> {
+    let path = match (explicit, format) {
+        (Some(path), None) => config::expand_path(path)?,
+        (Some(path), Some(format)) => config::expand_path(path)?.with_extension(format),
+        (None, format) => config::default_config_path(format.unwrap_or("toml"))?,
+    };
+    if path.exists() && !yes && !confirm(&format!("{:?} exists. Overwrite it?", path))? {
+        return Ok(());
+    }
+    for written in config::generate_starter(&path)? {
+        info!("Wrote {:?}", written);
+    }
+    Ok(())
+}
+
+// a y/N question on stderr; anything but yes is no
+fn confirm(question: &str) -> Result<bool> {
+    eprint!("{} [y/N] ", question);
+    io::stderr().flush()?;
+    let mut answer = String::new();
+    io::stdin().read_line(&mut answer)?;
+    Ok(matches!(answer.trim().to_lowercase().as_str(), "y" | "yes"))
+}
+
+async fn run_compare(args: CompareArgs, cfg: &Config) -> Result<()> {
+    if args.models.len() < 2 {
+        return Err(anyhow!("compare needs at least two models"));
+    }
+    let typed = context::resolve_file_references(
+        &args.prompt.join(" "),
+        &env::current_dir()?,
+        cfg.max_context_bytes
+            .unwrap_or(context::DEFAULT_MAX_CONTEXT_BYTES),
+    )?;
+    let prompt = read_prompt(typed)?;
+
+    let mut persona = load_persona(&args.persona, cfg)?;
+    // the same conversation ask would continue, so the answers are comparable
+    // with it; compare only reads the history, it doesn't summarize or add to it
+    let past_entries = if cfg.persist_history.unwrap_or(true) && !args.no_history {
+        history::load(&cfg.history_path()?)?
+    } else {
+        vec![]
+    };
+    let mut messages = vec![Message {
+        role: "system".to_string(),
+        content: build_system_prompt(&persona, cfg, &system_context(cfg)?),
+        images: vec![],
+    }];
+    messages.extend(past_entries.iter().map(|entry| Message {
+        role: entry.role.clone(),
+        content: entry.content.clone(),
+        images: vec![],
+    }));
+    messages.push(Message {
+        role: "user".to_string(),
+        content: prompt,
+        images: vec![],
+    });
+    let mut models = Vec::new();
+    for name in &args.models {
+        persona.model = name.clone();
+        models.push((name.clone(), new_model(&persona, cfg)?));
+    }
+
+    info!("Comparing: {}", args.models.join(", "));
+    logger::log_session("user", &messages[messages.len() - 1].content);
+    let results = {
+        let _spinner = spinner(cfg);
+        compare::run(messages, models, request_timeout(cfg)).await
+    };
+    for result in &results {
+        logger::log_session(&compare::header(result), &compare::body(result));
+        if let Some(usage) = result.usage {
+            logger::log_session_tokens(usage.total());
+        }
+    }
+
+    if output::is_json() {
+        for result in &results {
+            match &result.response {
+                Ok(response) => output::print_exchange(1, &result.model, response, result.usage),
+                Err(e) => output::print_error(&anyhow!("{}", e), Some(&result.model)),
+            }
+        }
+    } else if args.side_by_side {
+        print!("{}", compare::side_by_side(&results, terminal_width()));
+    } else {
+        for result in &results {
+            println!(
+                "\n--- {} ---\n{}",
+                compare::header(result),
+                compare::body(result)
+            );
+        }
+    }
+    Ok(())
+}
+
+async fn run_converse(args: ConverseArgs, cfg: &Config) -> Result<()> {
+    let _session = metrics::Session::start();
+    info!("Starting a conversation with: {}", args.persona.join(", "));
+
+    // load agents
+    let sys_ctx = system_context(cfg)?;
+    let mut agents = Vec::new();
+    for p_name in &args.persona {
+        let persona = load_persona(p_name, cfg)?;
+        let model = new_model(&persona, cfg)?;
+        let rag_store = new_rag_store(&persona, cfg).await?;
         agents.push(Agent {
+            system_prompt: build_system_prompt(&persona, cfg, &sys_ctx),
             persona,
             model,
             rag_store,
@@ -181,18 +1751,26 @@ async fn run_converse(args: ConverseArgs) -> Result<()> {
     }
 
     // initialize converse
-    let initial_prompt = args.prompt.join(" ");
+    let initial_prompt = context::resolve_file_references(
+        &args.prompt.join(" "),
+        &env::current_dir()?,
+        cfg.max_context_bytes
+            .unwrap_or(context::DEFAULT_MAX_CONTEXT_BYTES),
+    )?;
+    logger::log_session("user", &initial_prompt);
     let mut conversation_history = format!(
         "The user started the conversation with this prompt: \"{}\"",
         initial_prompt
     );
 
     // go
+    let mut session_usage = SessionUsage::default();
+    let timeout = request_timeout(cfg);
     for i in 0..args.turns {
         let current_agent_index = i % agents.len();
         let agent = &agents[current_agent_index];
 
-        println!(
+        info!(
             "\n--- Turn {}/{} | Speaking: {} ---",
             i + 1,
             args.turns,
@@ -213,31 +1791,44 @@ async fn run_converse(args: ConverseArgs) -> Result<()> {
 
         // abother prompt for this turn
         let turn_prompt = format!(
-            "YOUR ROLE:\n{system_prompt}\n\n{context}\n\nCONVERSATION HISTORY:\n---\n{history}\n---\n\nINSTRUCTIONS: Your name is {name}. Based on your role and the history, provide your response. Do NOT include your name or role in the response itself. Just give your conversational reply.",
-            system_prompt = agent.persona.system_prompt,
+            "{context}\n\nCONVERSATION HISTORY:\n---\n{history}\n---\n\nINSTRUCTIONS: Your name is {name}. Based on your role and the history, provide your response. Do NOT include your name or role in the response itself. Just give your conversational reply.",
             context = context_str,
             history = conversation_history,
             name = agent.persona.name
         );
 
-        let messages = vec![Message {
-            role: "user".to_string(),
-            content: turn_prompt,
-        }];
+        let messages = vec![
+            Message {
+                role: "system".to_string(),
+                content: agent.system_prompt.clone(),
+                images: vec![],
+            },
+            Message {
+                role: "user".to_string(),
+                content: turn_prompt,
+                images: vec![],
+            },
+        ];
 
         // agent's response
-        let mut response_stream = agent
-            .model
-            .ask_stream(&messages)
-            .await
+        log_messages(&messages);
+        let mut spinner = spinner(cfg);
+        let response_stream = within(timeout, agent.model.ask_stream(&messages))
+            .await?
             .map_err(|e| anyhow!(e))?;
-        let mut full_response = String::new();
-        while let Some(chunk_result) = response_stream.next().await {
-            let chunk = chunk_result.map_err(|e| anyhow!(e))?;
-            print!("{}", chunk);
-            io::stdout().flush()?;
-            full_response.push_str(&chunk);
-        }
+        let (full_response, interrupted) =
+            stream_response(response_stream, timeout, &mut spinner).await?;
+        println!();
+        logger::log_session(
+            &format!("{} ({})", agent.persona.name, agent.persona.model),
+            &full_response,
+        );
+        record_usage(
+            agent.model.as_ref(),
+            &agent.persona.model,
+            cfg,
+            &mut session_usage,
+        );
 
         // update history
         conversation_history.push_str(&format!(
@@ -245,8 +1836,36 @@ async fn run_converse(args: ConverseArgs) -> Result<()> {
             agent.persona.name,
             full_response.trim()
         ));
+        if interrupted {
+            break;
+        }
     }
 
-    println!("\n\n--- Conversation Finished ---");
+    info!("\n\n--- Conversation Finished ---");
+    print_session_usage(cfg, &session_usage);
+
+    if let Some(path) = &args.output {
+        save_response(path, &conversation_history)?;
+    }
+    Ok(())
+}
+
+// appends after a timestamped separator rather than overwriting earlier output
+fn save_response(path: &str, content: &str) -> Result<()> {
+    let exists = Path::new(path).exists();
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)
+        .with_context(|| format!("Failed to open output file: {:?}", path))?;
+    if exists {
+        writeln!(
+            file,
+            "\n--- [{}] ---\n",
+            Local::now().format("%Y-%m-%d %H:%M:%S")
+        )?;
+    }
+    writeln!(file, "{}", content.trim_end())
+        .with_context(|| format!("Failed to write output file: {:?}", path))?;
     Ok(())
 }
@@ -0,0 +1,327 @@
+// Prometheus metrics on `metrics_addr`, for runs that last (`aiterm watch`,
+// converse). Counted around every vendor call, so every command is covered.
+use crate::signals;
+use crate::vendors::{LanguageModel, Message, ResponseStream, TokenUsage};
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use std::collections::BTreeMap;
+use std::fmt::Write as _;
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
+use tokio_stream::StreamExt;
+
+// upper bounds, in seconds, of the request_duration_seconds buckets
+const BUCKETS: [f64; 9] = [0.5, 1.0, 2.5, 5.0, 10.0, 20.0, 30.0, 60.0, 120.0];
+// a scrape is one small GET; anything bigger or slower is dropped
+const MAX_REQUEST_HEAD: usize = 16 * 1024;
+const READ_TIMEOUT: Duration = Duration::from_secs(5);
+
+static ENABLED: AtomicBool = AtomicBool::new(false);
+static METRICS: Mutex<Metrics> = Mutex::new(Metrics {
+    requests: 0,
+    tokens_input: 0,
+    tokens_output: 0,
+    buckets: [0; BUCKETS.len()],
+    duration_sum: 0.0,
+    duration_count: 0,
+    errors: BTreeMap::new(),
+    active: 0,
+    sessions: 0,
+});
+
+struct Metrics {
+    requests: u64,
+    tokens_input: u64,
+    tokens_output: u64,
+    // not cumulative; render() adds them up
+    buckets: [u64; BUCKETS.len()],
+    duration_sum: f64,
+    duration_count: u64,
+    errors: BTreeMap<&'static str, u64>,
+    active: i64,
+    sessions: i64,
+}
+
+pub fn is_enabled() -> bool {
+    ENABLED.load(Ordering::Relaxed)
+}
+
+// a bare ":9090" listens on localhost only; give a host ("0.0.0.0:9090") to
+// publish usage to the network
+pub async fn serve(addr: &str) -> Result<()> {
+    let addr = match addr.strip_prefix(':') {
+        Some(port) => format!("127.0.0.1:{}", port),
+        None => addr.to_string(),
+    };
+    let listener = TcpListener::bind(&addr)
+        .await
+        .with_context(|| format!("Failed to listen on metrics_addr {:?}", addr))?;
+    ENABLED.store(true, Ordering::Relaxed);
+    tokio::spawn(async move {
+        loop {
+            let mut socket = tokio::select! {
+                accepted = listener.accept() => match accepted {
+                    Ok((socket, _)) => socket,
+                    Err(_) => break,
+                },
+                // stop taking scrapes while a stopped response is saved
+                _ = signals::terminating() => break,
+            };
+            tokio::spawn(async move {
+                let Ok(Some(path)) =
+                    tokio::time::timeout(READ_TIMEOUT, read_path(&mut socket)).await
+                else {
+                    return;
+                };
+                let response = if path == "/metrics" {
+                    let body = render();
+                    format!(
+                        "HTTP/1.1 200 OK\r\nContent-Type: text/plain; version=0.0.4\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                        body.len(),
+                        body
+                    )
+                } else {
+                    "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+                        .to_string()
+                };
+                let _ = socket.write_all(response.as_bytes()).await;
+            });
+        }
+    });
+    Ok(())
+}
+
+// the path from the request line, once the whole head has arrived; None for
+// a closed connection or a head over MAX_REQUEST_HEAD
+async fn read_path(socket: &mut TcpStream) -> Option<String> {
+    let mut head = Vec::new();
+    let mut chunk = [0u8; 1024];
+    while !head.windows(4).any(|w| w == b"\r\n\r\n") {
+        let n = socket.read(&mut chunk).await.ok()?;
+        if n == 0 || head.len() + n > MAX_REQUEST_HEAD {
+            return None;
+        }
+        head.extend_from_slice(&chunk[..n]);
+    }
+    let head = String::from_utf8_lossy(&head);
+    head.split_whitespace().nth(1).map(str::to_string)
+}
+
+fn render() -> String {
+    let m = METRICS.lock().unwrap();
+    let mut out = String::new();
+    let mut counter = |name: &str, help: &str, value: u64| {
+        let _ = writeln!(out, "# HELP {} {}", name, help);
+        let _ = writeln!(out, "# TYPE {} counter", name);
+        let _ = writeln!(out, "{} {}", name, value);
+    };
+    counter(
+        "aiterm_requests_total",
+        "Requests sent to a vendor.",
+        m.requests,
+    );
+    counter(
+        "aiterm_tokens_input_total",
+        "Prompt tokens reported by vendors.",
+        m.tokens_input,
+    );
+    counter(
+        "aiterm_tokens_output_total",
+        "Completion tokens reported by vendors.",
+        m.tokens_output,
+    );
+
+    out.push_str("# HELP aiterm_errors_total Failed requests, by type.\n");
+    out.push_str("# TYPE aiterm_errors_total counter\n");
+    for (kind, count) in &m.errors {
+        let _ = writeln!(out, "aiterm_errors_total{{type=\"{}\"}} {}", kind, count);
+    }
+
+    out.push_str("# HELP aiterm_request_duration_seconds Time until a response was complete.\n");
+    out.push_str("# TYPE aiterm_request_duration_seconds histogram\n");
+    let mut cumulative = 0;
+    for (bound, count) in BUCKETS.iter().zip(m.buckets) {
+        cumulative += count;
+        let _ = writeln!(
+            out,
+            "aiterm_request_duration_seconds_bucket{{le=\"{}\"}} {}",
+            bound, cumulative
+        );
+    }
+    let _ = writeln!(
+        out,
+        "aiterm_request_duration_seconds_bucket{{le=\"+Inf\"}} {}",
+        m.duration_count
+    );
+    let _ = writeln!(
+        out,
+        "aiterm_request_duration_seconds_sum {}",
+        m.duration_sum
+    );
+    let _ = writeln!(
+        out,
+        "aiterm_request_duration_seconds_count {}",
+        m.duration_count
+    );
+
+    out.push_str("# HELP aiterm_active_sessions Conversations and watches running right now.\n");
+    out.push_str("# TYPE aiterm_active_sessions gauge\n");
+    let _ = writeln!(out, "aiterm_active_sessions {}", m.sessions);
+
+    // finer than sessions: a session is mostly waiting on its user
+    out.push_str("# HELP aiterm_active_requests Requests waiting on a vendor right now.\n");
+    out.push_str("# TYPE aiterm_active_requests gauge\n");
+    let _ = writeln!(out, "aiterm_active_requests {}", m.active);
+    out
+}
+
+// held for as long as `converse` or `watch` runs
+pub struct Session;
+
+impl Session {
+    pub fn start() -> Self {
+        METRICS.lock().unwrap().sessions += 1;
+        Session
+    }
+}
+
+impl Drop for Session {
+    fn drop(&mut self) {
+        METRICS.lock().unwrap().sessions -= 1;
+    }
+}
+
+// one request from start to finish. Dropped unfinished (a timeout or
+// Ctrl+C gave up on it), it counts as a "cancelled" error.
+struct InFlight {
+    started: Instant,
+    done: bool,
+}
+
+impl InFlight {
+    fn start() -> Self {
+        let mut m = METRICS.lock().unwrap();
+        m.requests += 1;
+        m.active += 1;
+        InFlight {
+            started: Instant::now(),
+            done: false,
+        }
+    }
+
+    fn finish(&mut self, error: Option<&str>, usage: Option<TokenUsage>) {
+        if self.done {
+            return;
+        }
+        self.done = true;
+        let mut m = METRICS.lock().unwrap();
+        m.active -= 1;
+        let seconds = self.started.elapsed().as_secs_f64();
+        if let Some(i) = BUCKETS.iter().position(|bound| seconds <= *bound) {
+            m.buckets[i] += 1;
+        }
+        m.duration_sum += seconds;
+        m.duration_count += 1;
+        if let Some(error) = error {
+            *m.errors.entry(error_type(error)).or_default() += 1;
+        }
+        if let Some(usage) = usage {
+            m.tokens_input += u64::from(usage.prompt);
+            m.tokens_output += u64::from(usage.completion);
+        }
+    }
+}
+
+impl Drop for InFlight {
+    fn drop(&mut self) {
+        if !self.done {
+            let mut m = METRICS.lock().unwrap();
+            m.active -= 1;
+            *m.errors.entry("cancelled").or_default() += 1;
+        }
+    }
+}
+
+// vendors report errors as text; these are the kinds worth telling apart
+fn error_type(error: &str) -> &'static str {
+    let error = error.to_lowercase();
+    if error.contains("timed out") || error.contains("timeout") {
+        "timeout"
+    } else if error.contains("429") || error.contains("rate limit") {
+        "rate_limited"
+    } else if error.starts_with("api error") {
+        "api"
+    } else {
+        "other"
+    }
+}
+
+// wraps a vendor so every request is counted
+pub struct Metered {
+    inner: std::sync::Arc<dyn LanguageModel>,
+}
+
+impl Metered {
+    pub fn new(inner: Box<dyn LanguageModel>) -> Self {
+        Self {
+            inner: inner.into(),
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for Metered {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        let mut request = InFlight::start();
+        match self.inner.ask(messages).await {
+            Ok(response) => {
+                request.finish(None, self.inner.last_usage());
+                Ok(response)
+            }
+            Err(e) => {
+                request.finish(Some(&e.to_string()), None);
+                Err(e)
+            }
+        }
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        let mut request = InFlight::start();
+        let mut stream = match self.inner.ask_stream(messages).await {
+            Ok(stream) => stream,
+            Err(e) => {
+                request.finish(Some(&e.to_string()), None);
+                return Err(e);
+            }
+        };
+        let inner = self.inner.clone();
+        // the request lasts until the stream ends
+        let counted = async_stream::try_stream! {
+            while let Some(chunk) = stream.next().await {
+                if let Err(e) = &chunk {
+                    request.finish(Some(&e.to_string()), None);
+                }
+                yield chunk?;
+            }
+            request.finish(None, inner.last_usage());
+        };
+        Ok(Box::pin(counted))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.inner.last_usage()
+    }
+
+    fn supports_images(&self) -> bool {
+        self.inner.supports_images()
+    }
+}
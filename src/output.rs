@@ -0,0 +1,144 @@
+// --json: each answer as one JSON object on stdout, and errors in kind, so
+// other tools can read aiterm's output without scraping it
+use crate::pager;
+use crate::vendors::TokenUsage;
+use serde::Serialize;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+static JSON: AtomicBool = AtomicBool::new(false);
+
+pub fn set_json(on: bool) {
+    JSON.store(on, Ordering::Relaxed);
+}
+
+pub fn is_json() -> bool {
+    JSON.load(Ordering::Relaxed)
+}
+
+#[derive(Serialize)]
+struct Exchange<'a> {
+    turn: usize,
+    role: &'static str,
+    model: &'a str,
+    content: &'a str,
+    scripts: Vec<Script>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    tokens: Option<Tokens>,
+}
+
+#[derive(Serialize)]
+struct Script {
+    language: String,
+    code: String,
+}
+
+#[derive(Serialize)]
+struct Tokens {
+    input: u32,
+    output: u32,
+}
+
+#[derive(Serialize)]
+struct Failure<'a> {
+    error: String,
+    code: i32,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    model: Option<&'a str>,
+}
+
+pub fn print_exchange(turn: usize, model: &str, content: &str, usage: Option<TokenUsage>) {
+    let exchange = Exchange {
+        turn,
+        role: "assistant",
+        model,
+        content,
+        scripts: scripts(content),
+        tokens: usage.map(|u| Tokens {
+            input: u.prompt,
+            output: u.completion,
+        }),
+    };
+    print_line(&exchange);
+}
+
+// `model` says which one failed when several were asked (compare)
+pub fn print_error(error: &anyhow::Error, model: Option<&str>) {
+    print_line(&Failure {
+        error: format!("{:#}", error),
+        code: 1,
+        model,
+    });
+}
+
+fn print_line(value: &impl Serialize) {
+    match serde_json::to_string(value) {
+        Ok(line) => println!("{}", line),
+        Err(e) => eprintln!("Failed to write JSON output: {}", e),
+    }
+}
+
+// every fenced block, with the language from its opening fence ("" if none)
+fn scripts(content: &str) -> Vec<Script> {
+    let (_, blocks) = pager::split_code_blocks(content);
+    blocks
+        .iter()
+        .map(|block| {
+            let mut lines = block.lines();
+            let language = lines
+                .next()
+                .map(|fence| fence.trim_start().trim_start_matches('`').trim())
+                .unwrap_or_default()
+                .to_string();
+            let mut code: Vec<&str> = lines.collect();
+            if code
+                .last()
+                .is_some_and(|l| l.trim_start().starts_with("```"))
+            {
+                code.pop();
+            }
+            Script {
+                language,
+                code: code.join("\n"),
+            }
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn scripts_cases() {
+        let cases = [
+            ("no code here", vec![]),
+            ("```bash\nls -la\n```", vec![("bash", "ls -la")]),
+            ("```sh\nls\n```", vec![("sh", "ls")]),
+            ("```shell\nls\n```", vec![("shell", "ls")]),
+            ("```\nls\n```", vec![("", "ls")]),
+            ("``` sh \nls\n```", vec![("sh", "ls")]),
+            // CRLF around the fences and the code
+            (
+                "Run:\r\n```sh\r\nls\r\npwd\r\n```\r\n",
+                vec![("sh", "ls\npwd")],
+            ),
+            (
+                "```python\nprint(1)\n```\nthen\n```bash\necho 2\n```",
+                vec![("python", "print(1)"), ("bash", "echo 2")],
+            ),
+            // unclosed: the code runs to the end
+            ("```sh\nls\nmore", vec![("sh", "ls\nmore")]),
+        ];
+        for (content, want) in cases {
+            let got: Vec<(String, String)> = scripts(content)
+                .into_iter()
+                .map(|s| (s.language, s.code))
+                .collect();
+            let want: Vec<(String, String)> = want
+                .into_iter()
+                .map(|(l, c)| (l.to_string(), c.to_string()))
+                .collect();
+            assert_eq!(got, want, "{:?}", content);
+        }
+    }
+}
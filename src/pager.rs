@@ -0,0 +1,101 @@
+// long answers through less (or whatever `pager` says)
+use anyhow::{Context, Result, anyhow};
+use std::io::{ErrorKind, Write};
+use std::process::{Command, Stdio};
+
+pub const DEFAULT_PAGER: &str = "less -R";
+
+pub fn open(content: &str, cmd: &str) -> Result<()> {
+    let mut words = cmd.split_whitespace();
+    let program = words.next().ok_or_else(|| anyhow!("pager is empty"))?;
+    let mut child = Command::new(program)
+        .args(words)
+        .stdin(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("Failed to start pager {:?}", cmd))?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        // quitting the pager early closes the pipe; that's not an error
+        if let Err(e) = stdin.write_all(content.as_bytes()) {
+            if e.kind() != ErrorKind::BrokenPipe {
+                return Err(e).context("Failed to write to pager");
+            }
+        }
+    }
+    child.wait().context("Pager failed")?;
+    Ok(())
+}
+
+// the prose and the fenced code blocks, apart. Each block leaves a
+// placeholder behind so the prose still reads in order.
+pub fn split_code_blocks(text: &str) -> (String, Vec<String>) {
+    let mut prose = String::new();
+    let mut blocks: Vec<String> = Vec::new();
+    let mut in_code = false;
+
+    for line in text.lines() {
+        let fence = line.trim_start().starts_with("```");
+        if fence && !in_code {
+            blocks.push(String::new());
+            prose.push_str(&format!("[code block {} below]\n", blocks.len()));
+        }
+        if fence || in_code {
+            let block = blocks.last_mut().expect("opened above");
+            block.push_str(line);
+            block.push('\n');
+        } else {
+            prose.push_str(line);
+            prose.push('\n');
+        }
+        if fence {
+            in_code = !in_code;
+        }
+    }
+    (prose, blocks)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn split_code_blocks_cases() {
+        let cases = [
+            ("just prose\n", "just prose\n", vec![]),
+            (
+                "Run:\n```bash\nls -la\n```\ndone\n",
+                "Run:\n[code block 1 below]\ndone\n",
+                vec!["```bash\nls -la\n```\n"],
+            ),
+            // every tag, and none, is a fence
+            (
+                "```sh\na\n```\n```\nb\n```\n```shell\nc\n```\n",
+                "[code block 1 below]\n[code block 2 below]\n[code block 3 below]\n",
+                vec!["```sh\na\n```\n", "```\nb\n```\n", "```shell\nc\n```\n"],
+            ),
+            // indented fences, as inside a list item
+            (
+                "- step\n  ```\n  make\n  ```\n",
+                "- step\n[code block 1 below]\n",
+                vec!["  ```\n  make\n  ```\n"],
+            ),
+            // CRLF line endings
+            (
+                "Run:\r\n```sh\r\nls\r\n```\r\n",
+                "Run:\n[code block 1 below]\n",
+                vec!["```sh\nls\n```\n"],
+            ),
+            // an unclosed block runs to the end
+            (
+                "text\n```\nno end\n",
+                "text\n[code block 1 below]\n",
+                vec!["```\nno end\n"],
+            ),
+        ];
+        for (text, prose, blocks) in cases {
+            let (got_prose, got_blocks) = split_code_blocks(text);
+            assert_eq!(got_prose, prose, "{:?}", text);
+            assert_eq!(got_blocks, blocks, "{:?}", text);
+        }
+    }
+}
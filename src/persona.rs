@@ -0,0 +1,44 @@
+// personas that work without a file in ~/.config/aiterm/personas;
+// a file with the same name takes precedence
+use crate::config::Persona;
+
+pub const BUILT_IN: &[&str] = &["shell", "python", "devops", "explain", "minimal"];
+
+const DEFAULT_MODEL: &str = "gemini";
+
+pub fn get(name: &str) -> Option<Persona> {
+    let system_prompt = match name {
+        "shell" => {
+            "You are a shell expert. Answer with the shell commands or script that solve the \
+             user's task, in a single fenced code block, followed by a short explanation. \
+             Prefer portable POSIX sh unless the system context says otherwise."
+        }
+        "python" => {
+            "You are a Python expert. Solve the user's task with a self-contained Python 3 \
+             script using only the standard library unless asked otherwise, in a single \
+             fenced code block, followed by a short explanation. Use a shell one-liner only \
+             when it is clearly simpler."
+        }
+        "devops" => {
+            "You are a DevOps engineer fluent in Docker, Kubernetes, CI pipelines and cloud \
+             CLIs. Answer with the commands or manifests that solve the user's task, in \
+             fenced code blocks, and point out anything that changes running workloads."
+        }
+        "explain" => {
+            "You are a patient teacher. Explain commands, errors and concepts in plain prose, \
+             step by step, without code blocks. Mention what could go wrong and why."
+        }
+        "minimal" => {
+            "Answer with a single shell one-liner and nothing else: no explanation, no code \
+             fences."
+        }
+        _ => return None,
+    };
+    Some(Persona {
+        name: name.to_string(),
+        model: DEFAULT_MODEL.to_string(),
+        system_prompt: system_prompt.to_string(),
+        context_paths: Vec::new(),
+        max_tokens: None,
+    })
+}
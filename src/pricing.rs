@@ -0,0 +1,108 @@
+// rough list prices, to keep an eye on spend; not a bill
+use crate::vendors::TokenUsage;
+
+// (model prefix, USD per 1M input tokens, USD per 1M output tokens);
+// the longest matching prefix wins
+const PRICES: &[(&str, f64, f64)] = &[
+    ("gemini", 0.075, 0.30),
+    ("gemini-1.5-flash", 0.075, 0.30),
+    ("gemini-1.5-pro", 1.25, 5.00),
+    ("gpt-4o", 2.50, 10.00),
+    ("gpt-4o-mini", 0.15, 0.60),
+    ("gpt-4-turbo", 10.00, 30.00),
+    ("gpt-3.5-turbo", 0.50, 1.50),
+    ("claude-3-haiku", 0.25, 1.25),
+    ("claude-3-5-haiku", 0.80, 4.00),
+    ("claude-3-5-sonnet", 3.00, 15.00),
+    ("claude-3-7-sonnet", 3.00, 15.00),
+    ("claude-sonnet", 3.00, 15.00),
+    ("claude-3-opus", 15.00, 75.00),
+    ("claude-opus", 15.00, 75.00),
+    ("mistral-small", 0.20, 0.60),
+    ("mistral-large", 2.00, 6.00),
+    ("codestral", 0.30, 0.90),
+    ("command-r", 0.15, 0.60),
+    ("command-r-plus", 2.50, 10.00),
+    // runs locally
+    ("ollama:", 0.0, 0.0),
+];
+
+// None when the model isn't in the table
+pub fn estimate_cost(usage: &TokenUsage, model: &str) -> Option<f64> {
+    let model = match model {
+        "openai" => "gpt-4o",
+        m => {
+            let m = m.strip_prefix("openai:").unwrap_or(m);
+            let m = m.strip_prefix("bedrock:").unwrap_or(m);
+            m.strip_prefix("anthropic.").unwrap_or(m)
+        }
+    };
+    let (_, input, output) = PRICES
+        .iter()
+        .filter(|(prefix, _, _)| model.starts_with(prefix))
+        .max_by_key(|(prefix, _, _)| prefix.len())?;
+    Some((usage.prompt as f64 * input + usage.completion as f64 * output) / 1_000_000.0)
+}
+
+// totals over every response in one run (a whole converse, say)
+#[derive(Debug, Default)]
+pub struct SessionUsage {
+    pub usage: TokenUsage,
+    pub cost: f64,
+    // some responses came from models without a price
+    pub unpriced: bool,
+}
+
+impl SessionUsage {
+    pub fn add(&mut self, usage: TokenUsage, model: &str) {
+        self.usage.prompt += usage.prompt;
+        self.usage.completion += usage.completion;
+        match estimate_cost(&usage, model) {
+            Some(cost) => self.cost += cost,
+            None => self.unpriced = true,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn estimate_cost_cases() {
+        let usage = TokenUsage {
+            prompt: 1_000_000,
+            completion: 1_000_000,
+        };
+        let cases = [
+            ("gpt-4o", Some(12.50)),
+            // the longest prefix wins over "gpt-4o"
+            ("gpt-4o-mini", Some(0.75)),
+            ("openai", Some(12.50)),
+            ("openai:gpt-4o-mini", Some(0.75)),
+            ("gemini", Some(0.375)),
+            ("gemini-1.5-pro-latest", Some(6.25)),
+            ("bedrock:anthropic.claude-3-haiku-20240307-v1:0", Some(1.50)),
+            ("ollama:llama3.2", Some(0.0)),
+            ("grok-2", None),
+            ("custom", None),
+        ];
+        for (model, want) in cases {
+            let got = estimate_cost(&usage, model);
+            match (got, want) {
+                (Some(got), Some(want)) => assert!((got - want).abs() < 1e-9, "{}: {}", model, got),
+                _ => assert_eq!(got, want, "{}", model),
+            }
+        }
+    }
+
+    #[test]
+    fn estimate_cost_scales_with_tokens() {
+        let usage = TokenUsage {
+            prompt: 2_000,
+            completion: 500,
+        };
+        let cost = estimate_cost(&usage, "claude-3-5-sonnet").unwrap();
+        assert!((cost - (2_000.0 * 3.00 + 500.0 * 15.00) / 1_000_000.0).abs() < 1e-12);
+    }
+}
@@ -1,4 +1,7 @@
 // its all into todo
+use crate::config::expand_path;
+use crate::ui::{info, warning};
+use crate::vendors::http::HttpClient;
 use anyhow::{Context, Result};
 use serde::{Deserialize, Serialize};
 use std::path::Path;
@@ -43,35 +46,34 @@ struct TextChunk {
 // main store
 pub struct RagStore {
     api_key: String,
-    client: reqwest::Client,
+    http: HttpClient,
     chunks: Vec<TextChunk>,
     embeddings: Vec<Vec<f32>>,
 }
 
 impl RagStore {
-    pub async fn new(api_key: String, paths: &[String]) -> Result<Self> {
-        println!("Initializing...");
-        let client = reqwest::Client::new();
+    pub async fn new(http: HttpClient, api_key: String, paths: &[String]) -> Result<Self> {
+        info!("Initializing...");
         let chunks = Self::load_and_chunk_files(paths)?;
 
         if chunks.is_empty() {
-            println!("Warning: No text files found in context paths.");
+            warning!("No text files found in context paths.");
             return Ok(Self {
                 api_key,
-                client,
+                http,
                 chunks,
                 embeddings: vec![],
             });
         }
 
-        println!("Embedding {} text chunks via API...", chunks.len());
+        info!("Embedding {} text chunks via API...", chunks.len());
         let documents: Vec<String> = chunks.iter().map(|c| c.text.clone()).collect();
-        let embeddings = embed_batch(&client, &api_key, documents).await?;
-        println!("Embedding complete.");
+        let embeddings = embed_batch(&http, &api_key, documents).await?;
+        info!("Embedding complete.");
 
         Ok(Self {
             api_key,
-            client,
+            http,
             chunks,
             embeddings,
         })
@@ -81,7 +83,7 @@ impl RagStore {
         if self.chunks.is_empty() {
             return Ok(vec![]);
         }
-        let query_embedding = embed_batch(&self.client, &self.api_key, vec![query.to_string()])
+        let query_embedding = embed_batch(&self.http, &self.api_key, vec![query.to_string()])
             .await?
             .remove(0);
 
@@ -111,7 +113,7 @@ impl RagStore {
         const CHUNK_OVERLAP: usize = 200;
         let mut chunks = Vec::new();
         for path_str in paths {
-            let path = Path::new(path_str);
+            let path = &expand_path(path_str)?;
             if path.is_dir() {
                 for entry in WalkDir::new(path)
                     .into_iter()
@@ -169,7 +171,7 @@ fn is_text_file(path: &Path) -> bool {
 }
 
 async fn embed_batch(
-    client: &reqwest::Client,
+    http: &HttpClient,
     api_key: &str,
     texts: Vec<String>,
 ) -> Result<Vec<Vec<f32>>> {
@@ -188,10 +190,11 @@ async fn embed_batch(
         })
         .collect();
 
-    let res = client
-        .post(&url)
-        .json(&serde_json::json!({ "requests": requests }))
-        .send()
+    let res = http
+        .send(
+            http.post(&url)
+                .json(&serde_json::json!({ "requests": requests })),
+        )
         .await
         .context("Failed to send embedding request to API")?;
 
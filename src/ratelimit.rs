@@ -0,0 +1,326 @@
+// a local guard against burning through an API quota by accident: a token
+// bucket of max_requests_per_minute requests, refilled evenly over the
+// minute, and so many tokens a day. The state lives in a file, locked while
+// it is read and written, so it holds across runs, even ones running at once.
+use crate::context::estimate_tokens;
+use crate::ui::warning;
+use crate::vendors::{LanguageModel, Message, ResponseStream, TokenUsage};
+use anyhow::{Context, Result, anyhow};
+use async_trait::async_trait;
+use chrono::{DateTime, Local, NaiveDate, Utc};
+use serde::{Deserialize, Serialize};
+use std::fs::{File, OpenOptions};
+use std::io::{Read, Seek, Write};
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio_stream::StreamExt;
+
+#[derive(Serialize, Deserialize, Default)]
+#[serde(default)]
+struct State {
+    // requests left in the bucket as of `refilled`; None means full
+    bucket: Option<f64>,
+    refilled: Option<DateTime<Utc>>,
+    day: Option<NaiveDate>,
+    tokens: u64,
+}
+
+pub struct Limiter {
+    path: PathBuf,
+    per_minute: Option<u32>,
+    daily_tokens: Option<u64>,
+}
+
+impl Limiter {
+    pub fn new(path: PathBuf, per_minute: Option<u32>, daily_tokens: Option<u64>) -> Self {
+        Self {
+            path,
+            per_minute: per_minute.filter(|n| *n > 0),
+            daily_tokens: daily_tokens.filter(|n| *n > 0),
+        }
+    }
+
+    // waits for a request in the bucket, then takes it
+    pub async fn acquire(&self) -> Result<()> {
+        loop {
+            let wait = self.update(|state| {
+                if let Some(limit) = self.daily_tokens {
+                    if state.tokens >= limit {
+                        return Err(anyhow!(
+                            "max_daily_tokens ({}) reached for today ({} used)",
+                            limit,
+                            state.tokens
+                        ));
+                    }
+                }
+                let Some(limit) = self.per_minute else {
+                    return Ok(None);
+                };
+                let capacity = f64::from(limit);
+                let per_second = capacity / 60.0;
+                let now = Utc::now();
+                let elapsed = state
+                    .refilled
+                    .and_then(|t| (now - t).to_std().ok())
+                    .unwrap_or_default();
+                let bucket = state.bucket.unwrap_or(capacity);
+                let bucket = (bucket + elapsed.as_secs_f64() * per_second).min(capacity);
+                state.refilled = Some(now);
+                if bucket >= 1.0 {
+                    state.bucket = Some(bucket - 1.0);
+                    Ok(None)
+                } else {
+                    state.bucket = Some(bucket);
+                    Ok(Some(Duration::from_secs_f64((1.0 - bucket) / per_second)))
+                }
+            })?;
+            let Some(wait) = wait else {
+                return Ok(());
+            };
+            eprintln!("Rate limited, waiting {}s...", wait.as_secs().max(1));
+            tokio::time::sleep(wait.max(Duration::from_millis(100))).await;
+        }
+    }
+
+    pub fn add_tokens(&self, tokens: u64) -> Result<()> {
+        self.update(|state| {
+            state.tokens += tokens;
+            Ok(())
+        })
+    }
+
+    // reads, changes and writes the state under an exclusive lock on the
+    // file, so another aiterm can't write in between. A new day starts the
+    // token count over
+    fn update<T>(&self, change: impl FnOnce(&mut State) -> Result<T>) -> Result<T> {
+        let mut file = OpenOptions::new()
+            .read(true)
+            .write(true)
+            .create(true)
+            .truncate(false)
+            .open(&self.path)
+            .with_context(|| format!("Failed to open rate limit state: {:?}", self.path))?;
+        file.lock()
+            .with_context(|| format!("Failed to lock rate limit state: {:?}", self.path))?;
+        let mut state = self.read(&mut file)?;
+        let today = Local::now().date_naive();
+        if state.day != Some(today) {
+            state.day = Some(today);
+            state.tokens = 0;
+        }
+        let result = change(&mut state)?;
+        self.write(&mut file, &state)?;
+        Ok(result)
+    }
+
+    // a state that can't be read is an error: starting over from zero would
+    // quietly lift the daily cap
+    fn read(&self, file: &mut File) -> Result<State> {
+        let mut content = String::new();
+        file.read_to_string(&mut content)
+            .with_context(|| format!("Failed to read rate limit state: {:?}", self.path))?;
+        if content.trim().is_empty() {
+            return Ok(State::default());
+        }
+        serde_json::from_str(&content).with_context(|| {
+            format!(
+                "Rate limit state {:?} is corrupt; delete it to start the counts over",
+                self.path
+            )
+        })
+    }
+
+    fn write(&self, file: &mut File, state: &State) -> Result<()> {
+        let content = serde_json::to_string(state)?;
+        file.set_len(0)
+            .and_then(|_| file.rewind())
+            .and_then(|_| file.write_all(content.as_bytes()))
+            .with_context(|| format!("Failed to write rate limit state: {:?}", self.path))
+    }
+}
+
+// the tokens one request counts against max_daily_tokens. The vendor's own
+// count is used when it reports one; a response that is cut off (a timeout,
+// a dropped stream, an error partway through) never does, but was still
+// billed, so it is charged an estimate from the text when dropped
+struct Charge {
+    limiter: Arc<Limiter>,
+    prompt_tokens: usize,
+    received_tokens: usize,
+    settled: bool,
+}
+
+impl Charge {
+    fn new(limiter: Arc<Limiter>, messages: &[Message]) -> Self {
+        Self {
+            limiter,
+            prompt_tokens: messages.iter().map(|m| estimate_tokens(&m.content)).sum(),
+            received_tokens: 0,
+            settled: false,
+        }
+    }
+
+    fn received(&mut self, text: &str) {
+        self.received_tokens += estimate_tokens(text);
+    }
+
+    fn estimate(&self) -> u64 {
+        (self.prompt_tokens + self.received_tokens) as u64
+    }
+
+    fn settle(mut self, usage: Option<TokenUsage>) -> Result<()> {
+        self.settled = true;
+        let tokens = usage.map_or_else(|| self.estimate(), |u| u64::from(u.total()));
+        self.limiter.add_tokens(tokens)
+    }
+
+    // a request the vendor turned down costs nothing
+    fn refused(mut self) {
+        self.settled = true;
+    }
+}
+
+impl Drop for Charge {
+    fn drop(&mut self) {
+        if self.settled {
+            return;
+        }
+        if let Err(e) = self.limiter.add_tokens(self.estimate()) {
+            warning!("{:#}", e);
+        }
+    }
+}
+
+// wraps a vendor so every request goes through the limiter
+pub struct RateLimited {
+    inner: Arc<dyn LanguageModel>,
+    limiter: Arc<Limiter>,
+}
+
+impl RateLimited {
+    pub fn new(inner: Box<dyn LanguageModel>, limiter: Limiter) -> Self {
+        Self {
+            inner: inner.into(),
+            limiter: Arc::new(limiter),
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for RateLimited {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        self.limiter.acquire().await?;
+        // dropped unsettled if the caller gives up waiting
+        let mut charge = Charge::new(self.limiter.clone(), messages);
+        match self.inner.ask(messages).await {
+            Ok(response) => {
+                charge.received(&response);
+                charge.settle(self.inner.last_usage())?;
+                Ok(response)
+            }
+            Err(e) => {
+                charge.refused();
+                Err(e)
+            }
+        }
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        self.limiter.acquire().await?;
+        let mut charge = Charge::new(self.limiter.clone(), messages);
+        let mut stream = match self.inner.ask_stream(messages).await {
+            Ok(stream) => stream,
+            Err(e) => {
+                charge.refused();
+                return Err(e);
+            }
+        };
+        let inner = self.inner.clone();
+        // usage is only known once the stream has ended; a stream that errors
+        // or is dropped before then is charged by the estimate
+        let counted = async_stream::try_stream! {
+            while let Some(chunk) = stream.next().await {
+                let chunk = chunk?;
+                charge.received(&chunk);
+                yield chunk;
+            }
+            charge.settle(inner.last_usage())?;
+        };
+        Ok(Box::pin(counted))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.inner.last_usage()
+    }
+
+    fn supports_images(&self) -> bool {
+        self.inner.supports_images()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn scratch_limiter(name: &str) -> Arc<Limiter> {
+        let path = std::env::temp_dir().join(format!(
+            "aiterm-ratelimit-{}-{}.json",
+            name,
+            std::process::id()
+        ));
+        let _ = std::fs::remove_file(&path);
+        Arc::new(Limiter::new(path, None, Some(1_000_000)))
+    }
+
+    fn used(limiter: &Limiter) -> u64 {
+        limiter.update(|state| Ok(state.tokens)).unwrap()
+    }
+
+    fn message(content: &str) -> Message {
+        Message {
+            role: "user".to_string(),
+            content: content.to_string(),
+            images: vec![],
+        }
+    }
+
+    #[test]
+    fn charges() {
+        let limiter = scratch_limiter("charges");
+        let messages = [message(&"x".repeat(40))];
+
+        // the vendor's count wins
+        let mut charge = Charge::new(limiter.clone(), &messages);
+        charge.received("ignored");
+        charge
+            .settle(Some(TokenUsage {
+                prompt: 7,
+                completion: 3,
+            }))
+            .unwrap();
+        assert_eq!(used(&limiter), 10);
+
+        // no count: 40 chars of prompt and 8 of answer
+        let mut charge = Charge::new(limiter.clone(), &messages);
+        charge.received("12345678");
+        charge.settle(None).unwrap();
+        assert_eq!(used(&limiter), 22);
+
+        // cut off partway through
+        let mut charge = Charge::new(limiter.clone(), &messages);
+        charge.received("1234");
+        drop(charge);
+        assert_eq!(used(&limiter), 33);
+
+        Charge::new(limiter.clone(), &messages).refused();
+        assert_eq!(used(&limiter), 33);
+        std::fs::remove_file(&limiter.path).unwrap();
+    }
+}
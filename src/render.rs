@@ -0,0 +1,227 @@
+// just enough Markdown for a terminal: headings, emphasis, lists, quotes
+// and code. Code is recoloured but otherwise left alone so it can still be
+// copied out verbatim.
+const BOLD: &str = "\x1b[1m";
+// ends both bold and dim
+const NORMAL: &str = "\x1b[22m";
+const ITALIC: &str = "\x1b[3m";
+const NO_ITALIC: &str = "\x1b[23m";
+const UNDERLINE: &str = "\x1b[4m";
+const NO_UNDERLINE: &str = "\x1b[24m";
+const DIM: &str = "\x1b[2m";
+const CODE: &str = "\x1b[36m";
+const NO_COLOR: &str = "\x1b[39m";
+
+pub fn markdown(text: &str, width: usize) -> String {
+    let width = width.max(20);
+    let mut out = String::new();
+    let mut in_code = false;
+
+    for line in text.lines() {
+        let trimmed = line.trim_start();
+        let indent = &line[..line.len() - trimmed.len()];
+
+        if trimmed.starts_with("```") {
+            in_code = !in_code;
+            out.push_str(&format!("{}{}{}\n", DIM, line, NORMAL));
+            continue;
+        }
+        if in_code {
+            out.push_str(&format!("{}{}{}\n", CODE, line, NO_COLOR));
+            continue;
+        }
+
+        if let Some(heading) = heading_text(trimmed) {
+            out.push_str(&format!(
+                "{}{}{}{}{}\n",
+                BOLD,
+                UNDERLINE,
+                inline(heading),
+                NO_UNDERLINE,
+                NORMAL
+            ));
+        } else if is_rule(trimmed) {
+            out.push_str(&format!("{}{}{}\n", DIM, "─".repeat(width), NORMAL));
+        } else if let Some((marker, item)) = list_item(trimmed) {
+            let lead = format!("{}{} ", indent, marker);
+            let hang = " ".repeat(lead.chars().count());
+            out.push_str(&lead);
+            out.push_str(&inline(&wrap(
+                item,
+                width.saturating_sub(hang.len()),
+                &hang,
+            )));
+            out.push('\n');
+        } else if let Some(quote) = trimmed.strip_prefix('>') {
+            let bar = format!("{}{}│{} ", indent, DIM, NORMAL);
+            out.push_str(&bar);
+            out.push_str(&inline(&wrap(quote.trim_start(), width - 2, &bar)));
+            out.push('\n');
+        } else if trimmed.is_empty() {
+            out.push('\n');
+        } else {
+            out.push_str(indent);
+            out.push_str(&inline(&wrap(
+                trimmed,
+                width.saturating_sub(indent.len()),
+                indent,
+            )));
+            out.push('\n');
+        }
+    }
+    out
+}
+
+fn heading_text(line: &str) -> Option<&str> {
+    let hashes = line.chars().take_while(|&c| c == '#').count();
+    if !(1..=6).contains(&hashes) {
+        return None;
+    }
+    line[hashes..].strip_prefix(' ').map(str::trim)
+}
+
+// bullets become "•"; numbered items keep their number
+fn list_item(line: &str) -> Option<(String, &str)> {
+    for bullet in ["- ", "* ", "+ "] {
+        if let Some(item) = line.strip_prefix(bullet) {
+            return Some(("•".to_string(), item));
+        }
+    }
+    let digits = line.chars().take_while(char::is_ascii_digit).count();
+    if digits > 0 {
+        if let Some(item) = line[digits..].strip_prefix(". ") {
+            return Some((line[..digits + 1].to_string(), item));
+        }
+    }
+    None
+}
+
+// "---", "***", "- - -"...
+fn is_rule(line: &str) -> bool {
+    let line = line.replace(' ', "");
+    let first = line.chars().next();
+    line.len() >= 3
+        && matches!(first, Some('-' | '*' | '_'))
+        && line.chars().all(|c| Some(c) == first)
+}
+
+// greedy word wrap; continuation lines start with `hang`
+fn wrap(text: &str, width: usize, hang: &str) -> String {
+    let width = width.max(10);
+    let mut out = String::new();
+    let mut line_len = 0;
+    for word in text.split_whitespace() {
+        let len = word.chars().count();
+        if line_len > 0 && line_len + 1 + len > width {
+            out.push('\n');
+            out.push_str(hang);
+            line_len = 0;
+        } else if line_len > 0 {
+            out.push(' ');
+            line_len += 1;
+        }
+        out.push_str(word);
+        line_len += len;
+    }
+    out
+}
+
+// `code`, **bold** and *italic*; unmatched markers are left as they are
+fn inline(text: &str) -> String {
+    let mut out = String::new();
+    let mut rest = text;
+    while let Some(c) = rest.chars().next() {
+        if let Some(after) = rest.strip_prefix('`') {
+            if let Some(end) = after.find('`') {
+                out.push_str(&format!("{}{}{}", CODE, &after[..end], NO_COLOR));
+                rest = &after[end + 1..];
+                continue;
+            }
+        } else if let Some(after) = rest.strip_prefix("**") {
+            if let Some(end) = after.find("**").filter(|&end| end > 0) {
+                out.push_str(&format!("{}{}{}", BOLD, inline(&after[..end]), NORMAL));
+                rest = &after[end + 2..];
+                continue;
+            }
+        } else if let Some(after) = rest.strip_prefix('*') {
+            // "a * b" is arithmetic, not emphasis
+            if !after.starts_with(' ') {
+                if let Some(end) = after.find('*').filter(|&end| end > 0) {
+                    out.push_str(&format!("{}{}{}", ITALIC, inline(&after[..end]), NO_ITALIC));
+                    rest = &after[end + 1..];
+                    continue;
+                }
+            }
+        }
+        out.push(c);
+        rest = &rest[c.len_utf8()..];
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn markdown_cases() {
+        let cases = [
+            ("plain text", "plain text\n".to_string()),
+            (
+                "# Title",
+                format!("{}{}Title{}{}\n", BOLD, UNDERLINE, NO_UNDERLINE, NORMAL),
+            ),
+            ("#hashtag", "#hashtag\n".to_string()),
+            ("- item", "• item\n".to_string()),
+            ("  * nested", "  • nested\n".to_string()),
+            ("12. twelfth", "12. twelfth\n".to_string()),
+            ("> quoted", format!("{}│{} quoted\n", DIM, NORMAL)),
+            ("---", format!("{}{}{}\n", DIM, "─".repeat(20), NORMAL)),
+            ("- - -", format!("{}{}{}\n", DIM, "─".repeat(20), NORMAL)),
+            ("a **b** c", format!("a {}b{} c\n", BOLD, NORMAL)),
+            ("a *b* c", format!("a {}b{} c\n", ITALIC, NO_ITALIC)),
+            (
+                "run `ls -la` now",
+                format!("run {}ls -la{} now\n", CODE, NO_COLOR),
+            ),
+            ("2 * 3 * 4", "2 * 3 * 4\n".to_string()),
+            ("**unclosed", "**unclosed\n".to_string()),
+            ("", String::new()),
+            // code is recoloured but kept verbatim, markers and all
+            (
+                "```sh\necho **hi**  # *x*\n```",
+                format!(
+                    "{d}```sh{n}\n{c}echo **hi**  # *x*{nc}\n{d}```{n}\n",
+                    d = DIM,
+                    n = NORMAL,
+                    c = CODE,
+                    nc = NO_COLOR
+                ),
+            ),
+        ];
+        for (text, want) in cases {
+            assert_eq!(markdown(text, 20), want, "{:?}", text);
+        }
+    }
+
+    #[test]
+    fn markdown_wraps_to_width() {
+        let cases = [
+            (
+                "one two three four five six",
+                "one two three four\nfive six\n",
+            ),
+            (
+                "- one two three four five six",
+                "• one two three four\n  five six\n",
+            ),
+            (
+                "  one two three four five six",
+                "  one two three four\n  five six\n",
+            ),
+        ];
+        for (text, want) in cases {
+            assert_eq!(markdown(text, 20), want, "{:?}", text);
+        }
+    }
+}
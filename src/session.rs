@@ -0,0 +1,177 @@
+// saved history as a Markdown document people can read and share
+use crate::history::HistoryEntry;
+use anyhow::{Context, Result, anyhow};
+use chrono::Local;
+use std::fs;
+use std::path::Path;
+
+pub fn default_export_name() -> String {
+    format!("aiterm-session-{}.md", Local::now().format("%Y%m%d-%H%M%S"))
+}
+
+pub fn export_markdown(history: &[HistoryEntry], path: &Path) -> Result<()> {
+    let mut models: Vec<&str> = Vec::new();
+    for entry in history {
+        if !entry.model.is_empty() && !models.contains(&entry.model.as_str()) {
+            models.push(&entry.model);
+        }
+    }
+    let turns = history.iter().filter(|e| e.role == "user").count();
+
+    let mut doc = format!(
+        "# aiterm session\n\n- Date: {}\n- Model: {}\n- Turns: {}\n\n",
+        Local::now().format("%Y-%m-%d %H:%M:%S"),
+        models.join(", "),
+        turns
+    );
+    for entry in history {
+        let heading = match entry.role.as_str() {
+            "user" => "User",
+            _ => "Assistant",
+        };
+        // content goes in untouched so code fences survive
+        doc.push_str(&format!("## {}\n{}\n\n", heading, entry.content.trim_end()));
+    }
+
+    fs::write(path, doc).with_context(|| format!("Failed to write export file: {:?}", path))
+}
+
+// reads a file written by export_markdown back into history entries
+pub fn import_markdown(path: &Path) -> Result<Vec<HistoryEntry>> {
+    let doc = fs::read_to_string(path)
+        .with_context(|| format!("Failed to read session file: {:?}", path))?;
+
+    let mut model = String::new();
+    let mut entries = Vec::new();
+    let mut current: Option<(&str, Vec<&str>)> = None;
+    let mut in_fence = false;
+    for line in doc.lines() {
+        // a "## User" inside a code block is just content
+        let role = match line.trim_end() {
+            "## User" if !in_fence => Some("user"),
+            "## Assistant" if !in_fence => Some("model"),
+            _ => None,
+        };
+        if let Some(role) = role {
+            if let Some((prev, lines)) = current.replace((role, Vec::new())) {
+                entries.push(HistoryEntry::new(prev, lines.join("\n").trim(), "", &model));
+            }
+            continue;
+        }
+        if line.trim_start().starts_with("```") {
+            in_fence = !in_fence;
+        }
+        match current.as_mut() {
+            Some((_, lines)) => lines.push(line),
+            None => {
+                if let Some(m) = line.strip_prefix("- Model: ") {
+                    // several models are comma separated; keep the first
+                    model = m.split(',').next().unwrap_or("").trim().to_string();
+                }
+            }
+        }
+    }
+    if let Some((role, lines)) = current {
+        entries.push(HistoryEntry::new(role, lines.join("\n").trim(), "", &model));
+    }
+
+    if entries.is_empty() {
+        return Err(anyhow!(
+            "No '## User' or '## Assistant' sections found in {:?}; is it an aiterm export?",
+            path
+        ));
+    }
+    if let Some(empty) = entries.iter().position(|e| e.content.is_empty()) {
+        return Err(anyhow!(
+            "Section {} in {:?} is empty; the session file looks damaged",
+            empty + 1,
+            path
+        ));
+    }
+    Ok(entries)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::env;
+
+    fn import(doc: &str) -> Result<Vec<(String, String, String)>> {
+        let path = env::temp_dir().join(format!("aiterm-import-{}.md", std::process::id()));
+        fs::write(&path, doc).unwrap();
+        let entries = import_markdown(&path);
+        fs::remove_file(&path).unwrap();
+        Ok(entries?
+            .into_iter()
+            .map(|e| (e.role, e.content, e.model))
+            .collect())
+    }
+
+    #[test]
+    fn import_markdown_cases() {
+        let entry = |role: &str, content: &str, model: &str| {
+            (role.to_string(), content.to_string(), model.to_string())
+        };
+        let cases = [
+            (
+                "# aiterm session\n\n- Model: gemini\n\n## User\nhi\n\n## Assistant\nhello\n",
+                vec![
+                    entry("user", "hi", "gemini"),
+                    entry("model", "hello", "gemini"),
+                ],
+            ),
+            // the first of several models
+            (
+                "- Model: gpt-4o, claude-3-5-sonnet\n## User\nq\n",
+                vec![entry("user", "q", "gpt-4o")],
+            ),
+            // a heading inside a code block is content
+            (
+                "## Assistant\n```md\n## User\n```\n",
+                vec![entry("model", "```md\n## User\n```", "")],
+            ),
+            (
+                "## User\nline one\n\nline two\n## Assistant \nok\n",
+                vec![
+                    entry("user", "line one\n\nline two", ""),
+                    entry("model", "ok", ""),
+                ],
+            ),
+        ];
+        for (doc, want) in cases {
+            assert_eq!(import(doc).unwrap(), want, "{:?}", doc);
+        }
+    }
+
+    #[test]
+    fn import_markdown_errors() {
+        let cases = [
+            ("", "No '## User'"),
+            ("# notes\njust text\n", "No '## User'"),
+            ("## User\n\n## Assistant\nhello\n", "Section 1"),
+        ];
+        for (doc, want) in cases {
+            let error = import(doc).unwrap_err().to_string();
+            assert!(error.contains(want), "{:?}: {}", doc, error);
+        }
+    }
+
+    #[test]
+    fn export_then_import() {
+        let history = vec![
+            HistoryEntry::new("user", "list files", "shell", "gemini"),
+            HistoryEntry::new("model", "```sh\nls -la\n```", "shell", "gemini"),
+        ];
+        let path = env::temp_dir().join(format!("aiterm-export-{}.md", std::process::id()));
+        export_markdown(&history, &path).unwrap();
+        let imported = import_markdown(&path).unwrap();
+        fs::remove_file(&path).unwrap();
+        let pairs = |entries: &[HistoryEntry]| -> Vec<(String, String, String)> {
+            entries
+                .iter()
+                .map(|e| (e.role.clone(), e.content.clone(), e.model.clone()))
+                .collect()
+        };
+        assert_eq!(pairs(&imported), pairs(&history));
+    }
+}
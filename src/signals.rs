@@ -0,0 +1,98 @@
+// Ctrl+C stops a response in progress but leaves the program running; at any
+// other time it exits as usual. Once tokio listens for SIGINT the default
+// handler is gone for good, so exiting has to be done by hand.
+//
+// SIGTERM always ends the program, but a response in progress is stopped
+// the same way first, so what arrived still reaches the history. If that
+// takes longer than SHUTDOWN_GRACE the program exits anyway.
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+use tokio::signal;
+use tokio::sync::Notify;
+
+const SHUTDOWN_GRACE: Duration = Duration::from_secs(5);
+// 128 + the signal number, as a shell would report it
+const EXIT_INTERRUPTED: i32 = 130;
+const EXIT_TERMINATED: i32 = 143;
+
+static RESPONDING: AtomicBool = AtomicBool::new(false);
+static SHUTTING_DOWN: AtomicBool = AtomicBool::new(false);
+static TERMINATE: Notify = Notify::const_new();
+
+pub fn install() {
+    tokio::spawn(async {
+        while signal::ctrl_c().await.is_ok() {
+            if !RESPONDING.load(Ordering::SeqCst) {
+                std::process::exit(EXIT_INTERRUPTED);
+            }
+        }
+    });
+    #[cfg(unix)]
+    tokio::spawn(async {
+        use signal::unix::{SignalKind, signal};
+        let Ok(mut terminate) = signal(SignalKind::terminate()) else {
+            return;
+        };
+        if terminate.recv().await.is_none() {
+            return;
+        }
+        eprintln!("\nShutting down...");
+        if !RESPONDING.load(Ordering::SeqCst) {
+            std::process::exit(EXIT_TERMINATED);
+        }
+        SHUTTING_DOWN.store(true, Ordering::SeqCst);
+        TERMINATE.notify_waiters();
+        tokio::time::sleep(SHUTDOWN_GRACE).await;
+        std::process::exit(EXIT_TERMINATED);
+    });
+}
+
+// what a response in progress waits on to stop early: Ctrl+C or SIGTERM
+pub async fn interrupted() {
+    // registered before the flag is checked, so a notify_waiters() in
+    // between still wakes it
+    let terminate = TERMINATE.notified();
+    tokio::pin!(terminate);
+    terminate.as_mut().enable();
+    if SHUTTING_DOWN.load(Ordering::SeqCst) {
+        return;
+    }
+    tokio::select! {
+        _ = signal::ctrl_c() => {}
+        _ = terminate => {}
+    }
+}
+
+// resolves once SIGTERM has begun shutting the program down
+pub async fn terminating() {
+    let terminate = TERMINATE.notified();
+    tokio::pin!(terminate);
+    terminate.as_mut().enable();
+    if SHUTTING_DOWN.load(Ordering::SeqCst) {
+        return;
+    }
+    terminate.await;
+}
+
+// once a response stopped by SIGTERM has been saved
+pub fn exit_if_shutting_down() {
+    if SHUTTING_DOWN.load(Ordering::SeqCst) {
+        std::process::exit(EXIT_TERMINATED);
+    }
+}
+
+// while one of these is alive Ctrl+C is left to whoever awaits it
+pub struct Responding;
+
+impl Responding {
+    pub fn start() -> Self {
+        RESPONDING.store(true, Ordering::SeqCst);
+        Responding
+    }
+}
+
+impl Drop for Responding {
+    fn drop(&mut self) {
+        RESPONDING.store(false, Ordering::SeqCst);
+    }
+}
@@ -0,0 +1,188 @@
+// saved prompts with blanks: {{.Task}} is filled in from Task=value at run
+// time, and {{template "name"}} pulls in another saved template
+use anyhow::{Result, anyhow};
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+
+// names become config keys ("templates.<name>"), so no dots
+pub fn check_name(name: &str) -> Result<()> {
+    let valid = !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_'));
+    if !valid {
+        return Err(anyhow!(
+            "Invalid template name {:?}: use letters, digits, '-' and '_'",
+            name
+        ));
+    }
+    Ok(())
+}
+
+// "Task=compress files" -> ("Task", "compress files")
+pub fn parse_vars(args: &[String]) -> Result<HashMap<String, String>> {
+    args.iter()
+        .map(|arg| {
+            let (key, value) = arg
+                .split_once('=')
+                .ok_or_else(|| anyhow!("Expected Name=value, got {:?}", arg))?;
+            Ok((key.trim().to_string(), value.to_string()))
+        })
+        .collect()
+}
+
+pub fn expand(
+    templates: &BTreeMap<String, String>,
+    name: &str,
+    vars: &HashMap<String, String>,
+) -> Result<String> {
+    let mut missing = BTreeSet::new();
+    let expanded = expand_into(templates, name, vars, &mut Vec::new(), &mut missing)?;
+    if !missing.is_empty() {
+        let missing: Vec<&str> = missing.iter().map(String::as_str).collect();
+        return Err(anyhow!(
+            "Template {:?} needs {}; pass them as Name=value",
+            name,
+            missing.join(", ")
+        ));
+    }
+    Ok(expanded)
+}
+
+// `stack` is the chain of templates being expanded, to catch loops
+fn expand_into(
+    templates: &BTreeMap<String, String>,
+    name: &str,
+    vars: &HashMap<String, String>,
+    stack: &mut Vec<String>,
+    missing: &mut BTreeSet<String>,
+) -> Result<String> {
+    let body = templates
+        .get(name)
+        .ok_or_else(|| anyhow!("No template named {:?}", name))?;
+    if stack.iter().any(|n| n == name) {
+        stack.push(name.to_string());
+        return Err(anyhow!(
+            "Templates include each other: {}",
+            stack.join(" -> ")
+        ));
+    }
+    stack.push(name.to_string());
+
+    let mut out = String::new();
+    let mut rest = body.as_str();
+    while let Some(start) = rest.find("{{") {
+        out.push_str(&rest[..start]);
+        let after = &rest[start + 2..];
+        let end = after
+            .find("}}")
+            .ok_or_else(|| anyhow!("Unclosed {{{{ in template {:?}", name))?;
+        let action = after[..end].trim();
+        match action
+            .strip_prefix("template")
+            .filter(|arg| arg.starts_with(char::is_whitespace))
+        {
+            Some(arg) => {
+                let partial = quoted(arg.trim()).ok_or_else(|| {
+                    anyhow!("In template {:?}: expected {{{{template \"name\"}}}}", name)
+                })?;
+                out.push_str(&expand_into(templates, partial, vars, stack, missing)?);
+            }
+            None => {
+                let var = action.strip_prefix('.').unwrap_or(action);
+                match vars.get(var) {
+                    Some(value) => out.push_str(value),
+                    None => {
+                        missing.insert(var.to_string());
+                    }
+                }
+            }
+        }
+        rest = &after[end + 2..];
+    }
+    out.push_str(rest);
+    stack.pop();
+    Ok(out)
+}
+
+// the name in `"name"` or `"name" .`
+fn quoted(arg: &str) -> Option<&str> {
+    let inner = arg.strip_prefix('"')?;
+    inner.find('"').map(|end| &inner[..end])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn templates() -> BTreeMap<String, String> {
+        [
+            ("plain", "list files"),
+            ("task", "Write a script to {{.Task}} in {{ .Dir }}"),
+            ("bare", "{{Task}}!"),
+            ("wrapper", "{{template \"task\"}}, safely"),
+            ("loop-a", "{{template \"loop-b\"}}"),
+            ("loop-b", "{{template \"loop-a\"}}"),
+            ("self", "{{template \"self\"}}"),
+            ("unclosed", "{{.Task"),
+            ("bad-include", "{{template task}}"),
+            ("missing-include", "{{template \"nope\"}}"),
+        ]
+        .into_iter()
+        .map(|(name, body)| (name.to_string(), body.to_string()))
+        .collect()
+    }
+
+    fn vars(pairs: &[(&str, &str)]) -> HashMap<String, String> {
+        pairs
+            .iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect()
+    }
+
+    #[test]
+    fn expand_cases() {
+        let both = [("Task", "compress logs"), ("Dir", "/var/log")];
+        let cases = [
+            ("plain", vec![], "list files"),
+            (
+                "task",
+                both.to_vec(),
+                "Write a script to compress logs in /var/log",
+            ),
+            ("bare", vec![("Task", "go")], "go!"),
+            (
+                "wrapper",
+                both.to_vec(),
+                "Write a script to compress logs in /var/log, safely",
+            ),
+        ];
+        for (name, pairs, want) in cases {
+            assert_eq!(
+                expand(&templates(), name, &vars(&pairs)).unwrap(),
+                want,
+                "{}",
+                name
+            );
+        }
+    }
+
+    #[test]
+    fn expand_errors() {
+        let cases = [
+            ("task", vec![("Task", "x")], "needs Dir"),
+            ("task", vec![], "needs Dir, Task"),
+            ("loop-a", vec![], "loop-a -> loop-b -> loop-a"),
+            ("self", vec![], "self -> self"),
+            ("unclosed", vec![], "Unclosed {{"),
+            ("bad-include", vec![], "expected {{template \"name\"}}"),
+            ("missing-include", vec![], "No template named \"nope\""),
+            ("nope", vec![], "No template named \"nope\""),
+        ];
+        for (name, pairs, want) in cases {
+            let error = expand(&templates(), name, &vars(&pairs))
+                .unwrap_err()
+                .to_string();
+            assert!(error.contains(want), "{}: {:?}", name, error);
+        }
+    }
+}
@@ -0,0 +1,111 @@
+use std::io::{self, Write};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::task::JoinHandle;
+
+static QUIET: AtomicBool = AtomicBool::new(false);
+
+pub fn set_quiet(on: bool) {
+    QUIET.store(on, Ordering::Relaxed);
+}
+
+pub fn is_quiet() -> bool {
+    QUIET.load(Ordering::Relaxed)
+}
+
+// status lines; dropped with --quiet so stdout is only the answer
+macro_rules! info {
+    ($($arg:tt)*) => {
+        if !$crate::ui::is_quiet() {
+            println!($($arg)*);
+        }
+    };
+}
+pub(crate) use info;
+
+// always on stderr, even with --quiet, so piped answers and --json stay clean
+macro_rules! warning {
+    ($($arg:tt)*) => {
+        eprintln!("Warning: {}", format_args!($($arg)*))
+    };
+}
+pub(crate) use warning;
+
+// false when the user wants to stop
+pub fn wait_for_more() -> io::Result<bool> {
+    eprint!("-- more (enter to continue, q to quit) --");
+    io::stderr().flush()?;
+    let mut answer = String::new();
+    io::stdin().read_line(&mut answer)?;
+    Ok(!answer.trim().eq_ignore_ascii_case("q"))
+}
+
+// writes `text`, pausing after every `page_lines` lines when given
+pub fn print_paged(
+    text: &str,
+    writer: &mut impl Write,
+    page_lines: Option<usize>,
+) -> io::Result<()> {
+    for (i, line) in text.lines().enumerate() {
+        if let Some(page) = page_lines {
+            // leave a line for the prompt itself
+            if i > 0 && i % page.saturating_sub(1).max(1) == 0 && !wait_for_more()? {
+                break;
+            }
+        }
+        writeln!(writer, "{}", line)?;
+    }
+    Ok(())
+}
+
+const FRAMES: [&str; 10] = ["⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"];
+
+// drawn on stderr while waiting for the first bit of a response.
+// Stops on stop() or when dropped.
+pub struct Spinner {
+    task: Option<(JoinHandle<()>, Arc<Mutex<bool>>)>,
+}
+
+impl Spinner {
+    pub fn start() -> Self {
+        // held while drawing so stop() can't clear the line mid-frame
+        let stopped = Arc::new(Mutex::new(false));
+        let flag = stopped.clone();
+        let handle = tokio::spawn(async move {
+            let mut interval = tokio::time::interval(Duration::from_millis(100));
+            for frame in FRAMES.iter().cycle() {
+                interval.tick().await;
+                let stopped = flag.lock().unwrap();
+                if *stopped {
+                    break;
+                }
+                eprint!("\r{} ", frame);
+                let _ = io::stderr().flush();
+            }
+        });
+        Self {
+            task: Some((handle, stopped)),
+        }
+    }
+
+    // for output that isn't going to a terminal
+    pub fn disabled() -> Self {
+        Self { task: None }
+    }
+
+    pub fn stop(&mut self) {
+        if let Some((handle, stopped)) = self.task.take() {
+            *stopped.lock().unwrap() = true;
+            handle.abort();
+            eprint!("\r  \r");
+            let _ = io::stderr().flush();
+        }
+    }
+}
+
+impl Drop for Spinner {
+    fn drop(&mut self) {
+        self.stop();
+    }
+}
@@ -0,0 +1,200 @@
+use super::http::HttpClient;
+use super::{LanguageModel, Message, ResponseStream, TokenUsage, UsageSlot, Utf8Decoder};
+use async_stream::try_stream;
+use async_trait::async_trait;
+use serde::{Deserialize, Serialize};
+use tokio_stream::StreamExt;
+
+const API_VERSION: &str = "2023-06-01";
+// max_tokens is mandatory on the messages API
+const DEFAULT_MAX_TOKENS: u32 = 4096;
+
+// Request Structures
+#[derive(Serialize)]
+struct RequestBody {
+    model: String,
+    max_tokens: u32,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    system: Option<String>,
+    messages: Vec<RequestMessage>,
+    stream: bool,
+}
+#[derive(Serialize)]
+struct RequestMessage {
+    role: String,
+    content: String,
+}
+
+// Response Structures (streamed events)
+#[derive(Deserialize)]
+struct StreamEvent {
+    #[serde(rename = "type")]
+    kind: String,
+    #[serde(default)]
+    delta: Option<EventDelta>,
+    #[serde(default)]
+    error: Option<EventError>,
+    // message_start carries the input count, message_delta the output count
+    #[serde(default)]
+    message: Option<EventMessage>,
+    #[serde(default)]
+    usage: Option<EventUsage>,
+}
+#[derive(Deserialize)]
+struct EventMessage {
+    #[serde(default)]
+    usage: Option<EventUsage>,
+}
+#[derive(Deserialize)]
+struct EventUsage {
+    #[serde(default)]
+    input_tokens: u32,
+    #[serde(default)]
+    output_tokens: u32,
+}
+#[derive(Deserialize)]
+struct EventDelta {
+    #[serde(default)]
+    text: Option<String>,
+}
+#[derive(Deserialize)]
+struct EventError {
+    message: String,
+}
+
+pub struct Anthropic {
+    api_key: String,
+    model: String,
+    max_tokens: u32,
+    http: HttpClient,
+    usage: UsageSlot,
+}
+
+impl Anthropic {
+    pub fn new(http: HttpClient, api_key: String, model: &str, max_tokens: Option<u32>) -> Self {
+        Self {
+            api_key,
+            model: model.to_string(),
+            max_tokens: max_tokens.filter(|&n| n > 0).unwrap_or(DEFAULT_MAX_TOKENS),
+            http,
+            usage: UsageSlot::default(),
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for Anthropic {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        let mut stream = self.ask_stream(messages).await?;
+        let mut full_response = String::new();
+        while let Some(chunk_result) = stream.next().await {
+            let chunk = chunk_result?;
+            full_response.push_str(&chunk);
+        }
+        Ok(full_response)
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        let url = "https://api.anthropic.com/v1/messages";
+
+        // system prompts go in their own field, not in the message list
+        let system: Vec<&str> = messages
+            .iter()
+            .filter(|msg| msg.role == "system")
+            .map(|msg| msg.content.as_str())
+            .collect();
+
+        let request_messages: Vec<RequestMessage> = messages
+            .iter()
+            .filter(|msg| msg.role != "system")
+            .map(|msg| RequestMessage {
+                role: match msg.role.as_str() {
+                    "model" => "assistant".to_string(),
+                    role => role.to_string(),
+                },
+                content: msg.content.clone(),
+            })
+            .collect();
+
+        let request_body = RequestBody {
+            model: self.model.clone(),
+            max_tokens: self.max_tokens,
+            system: (!system.is_empty()).then(|| system.join("\n\n")),
+            messages: request_messages,
+            stream: true,
+        };
+
+        self.usage.clear();
+        let request = self
+            .http
+            .post(url)
+            .header("x-api-key", &self.api_key)
+            .header("anthropic-version", API_VERSION)
+            .json(&request_body);
+        let res = self.http.send(request).await?;
+
+        if !res.status().is_success() {
+            let status = res.status();
+            let error_text = res.text().await?;
+            return Err(format!("API Error: {} - {}", status, error_text).into());
+        }
+
+        let mut byte_stream = res.bytes_stream();
+        let usage = self.usage.clone();
+
+        // server-sent events; only the text deltas and errors matter here
+        let stream = try_stream! {
+            let mut buffer = String::new();
+            let mut decoder = Utf8Decoder::default();
+            let mut counts = TokenUsage::default();
+            'outer: while let Some(chunk_result) = byte_stream.next().await {
+                let chunk = chunk_result?;
+                buffer.push_str(&decoder.decode(&chunk));
+
+                while let Some(newline_idx) = buffer.find('\n') {
+                    let line: String = buffer.drain(..=newline_idx).collect();
+                    let Some(data) = line.trim().strip_prefix("data:") else { continue; };
+                    let Ok(event) = serde_json::from_str::<StreamEvent>(data.trim()) else { continue; };
+                    match event.kind.as_str() {
+                        "message_start" => {
+                            if let Some(u) = event.message.and_then(|m| m.usage) {
+                                counts.prompt = u.input_tokens;
+                                counts.completion = u.output_tokens;
+                                usage.set(counts);
+                            }
+                        }
+                        "message_delta" => {
+                            if let Some(u) = event.usage {
+                                counts.completion = u.output_tokens;
+                                usage.set(counts);
+                            }
+                        }
+                        "content_block_delta" => {
+                            if let Some(text) = event.delta.and_then(|d| d.text) {
+                                if !text.is_empty() { yield text; }
+                            }
+                        }
+                        "error" => {
+                            let message = event.error.map(|e| e.message).unwrap_or_default();
+                            Err::<(), _>(format!("API Error: {}", message))?;
+                        }
+                        "message_stop" => break 'outer,
+                        _ => {}
+                    }
+                }
+            }
+        };
+
+        Ok(Box::pin(stream))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.usage.get()
+    }
+}
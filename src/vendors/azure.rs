@@ -0,0 +1,91 @@
+use super::http::HttpClient;
+use super::openai::{RequestBody, chunk_stream, request_messages};
+use super::{LanguageModel, Message, ResponseStream, TokenUsage, UsageSlot};
+use async_trait::async_trait;
+use tokio_stream::StreamExt;
+
+const DEFAULT_API_VERSION: &str = "2024-02-01";
+
+// azure openai routes by deployment name instead of model name
+pub struct Azure {
+    api_key: String,
+    endpoint: String,
+    deployment: String,
+    api_version: String,
+    http: HttpClient,
+    usage: UsageSlot,
+}
+
+impl Azure {
+    pub fn new(
+        http: HttpClient,
+        api_key: String,
+        endpoint: &str,
+        deployment: &str,
+        api_version: Option<&str>,
+    ) -> Self {
+        Self {
+            api_key,
+            endpoint: endpoint.trim_end_matches('/').to_string(),
+            deployment: deployment.to_string(),
+            api_version: api_version.unwrap_or(DEFAULT_API_VERSION).to_string(),
+            http,
+            usage: UsageSlot::default(),
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for Azure {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        let mut stream = self.ask_stream(messages).await?;
+        let mut full_response = String::new();
+        while let Some(chunk_result) = stream.next().await {
+            let chunk = chunk_result?;
+            full_response.push_str(&chunk);
+        }
+        Ok(full_response)
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        let url = format!(
+            "{}/openai/deployments/{}/chat/completions",
+            self.endpoint, self.deployment
+        );
+
+        let request_body = RequestBody {
+            model: self.deployment.clone(),
+            messages: request_messages(messages),
+            stream: true,
+            // older api versions reject stream_options
+            stream_options: None,
+        };
+
+        self.usage.clear();
+        let request = self
+            .http
+            .post(&url)
+            .query(&[("api-version", &self.api_version)])
+            .header("api-key", &self.api_key)
+            .json(&request_body);
+        let res = self.http.send(request).await?;
+
+        if !res.status().is_success() {
+            let status = res.status();
+            let error_text = res.text().await?;
+            return Err(format!("API Error: {} - {}", status, error_text).into());
+        }
+
+        Ok(chunk_stream(res, self.usage.clone()))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.usage.get()
+    }
+}
@@ -0,0 +1,243 @@
+use super::{LanguageModel, Message, ResponseStream, TokenUsage, UsageSlot};
+use crate::logger::verbose;
+use async_stream::try_stream;
+use async_trait::async_trait;
+use aws_config::retry::RetryConfig;
+use aws_config::timeout::TimeoutConfig;
+use aws_config::{BehaviorVersion, Region};
+use aws_sdk_bedrockruntime::Client;
+use aws_sdk_bedrockruntime::primitives::Blob;
+use aws_sdk_bedrockruntime::types::ResponseStream as BedrockEvent;
+use serde::Deserialize;
+use std::time::Duration;
+use tokio::sync::OnceCell;
+use tokio_stream::StreamExt;
+
+const DEFAULT_MAX_TOKENS: u32 = 4096;
+
+// Response Structures (one JSON payload per stream chunk)
+#[derive(Deserialize)]
+struct ClaudeChunk {
+    #[serde(rename = "type")]
+    kind: String,
+    #[serde(default)]
+    delta: Option<ClaudeDelta>,
+}
+#[derive(Deserialize)]
+struct ClaudeDelta {
+    #[serde(default)]
+    text: Option<String>,
+}
+#[derive(Deserialize)]
+struct TitanChunk {
+    #[serde(default, rename = "outputText")]
+    output_text: Option<String>,
+}
+
+// bedrock appends these to the last chunk, whatever the model family
+#[derive(Deserialize)]
+struct MetricsChunk {
+    #[serde(rename = "amazon-bedrock-invocationMetrics")]
+    metrics: InvocationMetrics,
+}
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct InvocationMetrics {
+    input_token_count: u32,
+    output_token_count: u32,
+}
+
+// bedrock hosts several model families, each with its own body format
+#[derive(Clone, Copy)]
+enum Family {
+    Claude,
+    Titan,
+}
+
+pub struct Bedrock {
+    region: Option<String>,
+    max_retries: u32,
+    connect_timeout: Duration,
+    model_id: String,
+    family: Family,
+    max_tokens: u32,
+    client: OnceCell<Client>,
+    usage: UsageSlot,
+}
+
+impl Bedrock {
+    // credentials come from the standard aws chain (env, profile, role...);
+    // the sdk makes its own connections and does its own retrying, so only
+    // the retry count and connect timeout are passed down
+    pub fn new(
+        region: Option<&str>,
+        max_retries: u32,
+        connect_timeout: Duration,
+        model: &str,
+        max_tokens: Option<u32>,
+    ) -> Result<Self, Box<dyn std::error::Error + Send + Sync>> {
+        let model_id = model.strip_prefix("bedrock:").unwrap_or(model);
+        let family = if model_id.contains("anthropic.") {
+            Family::Claude
+        } else if model_id.contains("amazon.titan") {
+            Family::Titan
+        } else {
+            return Err(format!("Unsupported Bedrock model '{}'", model_id).into());
+        };
+        Ok(Self {
+            region: region.map(str::to_string),
+            max_retries,
+            connect_timeout,
+            model_id: model_id.to_string(),
+            family,
+            max_tokens: max_tokens.filter(|&n| n > 0).unwrap_or(DEFAULT_MAX_TOKENS),
+            client: OnceCell::new(),
+            usage: UsageSlot::default(),
+        })
+    }
+
+    async fn client(&self) -> &Client {
+        self.client
+            .get_or_init(|| async {
+                let mut loader = aws_config::defaults(BehaviorVersion::latest())
+                    .retry_config(RetryConfig::standard().with_max_attempts(self.max_retries + 1))
+                    .timeout_config(
+                        TimeoutConfig::builder()
+                            .connect_timeout(self.connect_timeout)
+                            .build(),
+                    );
+                if let Some(region) = &self.region {
+                    loader = loader.region(Region::new(region.clone()));
+                }
+                Client::new(&loader.load().await)
+            })
+            .await
+    }
+
+    fn request_body(&self, messages: &[Message]) -> serde_json::Value {
+        match self.family {
+            Family::Claude => {
+                let system: Vec<&str> = messages
+                    .iter()
+                    .filter(|msg| msg.role == "system")
+                    .map(|msg| msg.content.as_str())
+                    .collect();
+                let turns: Vec<serde_json::Value> = messages
+                    .iter()
+                    .filter(|msg| msg.role != "system")
+                    .map(|msg| {
+                        let role = if msg.role == "model" {
+                            "assistant"
+                        } else {
+                            "user"
+                        };
+                        serde_json::json!({ "role": role, "content": msg.content })
+                    })
+                    .collect();
+                let mut body = serde_json::json!({
+                    "anthropic_version": "bedrock-2023-05-31",
+                    "max_tokens": self.max_tokens,
+                    "messages": turns,
+                });
+                if !system.is_empty() {
+                    body["system"] = system.join("\n\n").into();
+                }
+                body
+            }
+            // titan has no chat format, so flatten everything into one transcript
+            Family::Titan => {
+                let transcript: Vec<String> = messages
+                    .iter()
+                    .map(|msg| match msg.role.as_str() {
+                        "system" => msg.content.clone(),
+                        "model" => format!("Bot: {}", msg.content),
+                        _ => format!("User: {}", msg.content),
+                    })
+                    .collect();
+                serde_json::json!({
+                    "inputText": format!("{}\nBot:", transcript.join("\n\n")),
+                    "textGenerationConfig": { "maxTokenCount": self.max_tokens },
+                })
+            }
+        }
+    }
+}
+
+fn chunk_text(family: Family, payload: &[u8]) -> Option<String> {
+    match family {
+        Family::Claude => {
+            let chunk: ClaudeChunk = serde_json::from_slice(payload).ok()?;
+            if chunk.kind != "content_block_delta" {
+                return None;
+            }
+            chunk.delta.and_then(|d| d.text)
+        }
+        Family::Titan => {
+            let chunk: TitanChunk = serde_json::from_slice(payload).ok()?;
+            chunk.output_text
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for Bedrock {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        let mut stream = self.ask_stream(messages).await?;
+        let mut full_response = String::new();
+        while let Some(chunk_result) = stream.next().await {
+            let chunk = chunk_result?;
+            full_response.push_str(&chunk);
+        }
+        Ok(full_response)
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        let body = serde_json::to_vec(&self.request_body(messages))?;
+
+        self.usage.clear();
+        verbose!("invoking bedrock model {}", self.model_id);
+        let output = self
+            .client()
+            .await
+            .invoke_model_with_response_stream()
+            .model_id(&self.model_id)
+            .content_type("application/json")
+            .accept("application/json")
+            .body(Blob::new(body))
+            .send()
+            .await?;
+
+        let mut events = output.body;
+        let family = self.family;
+        let usage = self.usage.clone();
+
+        let stream = try_stream! {
+            while let Some(event) = events.recv().await? {
+                if let BedrockEvent::Chunk(part) = event {
+                    let Some(bytes) = part.bytes() else { continue; };
+                    if let Ok(mc) = serde_json::from_slice::<MetricsChunk>(bytes.as_ref()) {
+                        usage.set(TokenUsage {
+                            prompt: mc.metrics.input_token_count,
+                            completion: mc.metrics.output_token_count,
+                        });
+                    }
+                    if let Some(text) = chunk_text(family, bytes.as_ref()) {
+                        if !text.is_empty() { yield text; }
+                    }
+                }
+            }
+        };
+
+        Ok(Box::pin(stream))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.usage.get()
+    }
+}
@@ -0,0 +1,183 @@
+use super::http::HttpClient;
+use super::{LanguageModel, Message, ResponseStream, TokenUsage, UsageSlot, Utf8Decoder};
+use async_stream::try_stream;
+use async_trait::async_trait;
+use serde::{Deserialize, Serialize};
+use tokio_stream::StreamExt;
+
+const URL: &str = "https://api.cohere.ai/v1/chat";
+
+// Request Structures: the newest user turn is `message`, everything before
+// it goes in `chat_history`, and the system prompt is the `preamble`
+#[derive(Serialize)]
+struct RequestBody {
+    model: String,
+    message: String,
+    chat_history: Vec<HistoryMessage>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    preamble: Option<String>,
+    stream: bool,
+}
+#[derive(Serialize)]
+struct HistoryMessage {
+    role: &'static str,
+    message: String,
+}
+
+// Response Structures (one JSON event per line)
+#[derive(Deserialize)]
+struct Event {
+    event_type: String,
+    #[serde(default)]
+    text: Option<String>,
+    // stream-end only
+    #[serde(default)]
+    finish_reason: Option<String>,
+    #[serde(default)]
+    response: Option<EndResponse>,
+}
+#[derive(Deserialize)]
+struct EndResponse {
+    #[serde(default)]
+    meta: Option<Meta>,
+}
+#[derive(Deserialize)]
+struct Meta {
+    #[serde(default)]
+    billed_units: Option<BilledUnits>,
+}
+#[derive(Deserialize)]
+struct BilledUnits {
+    #[serde(default)]
+    input_tokens: f64,
+    #[serde(default)]
+    output_tokens: f64,
+}
+
+pub struct Cohere {
+    api_key: String,
+    model: String,
+    http: HttpClient,
+    usage: UsageSlot,
+}
+
+impl Cohere {
+    pub fn new(http: HttpClient, api_key: String, model: &str) -> Self {
+        Self {
+            api_key,
+            model: model.to_string(),
+            http,
+            usage: UsageSlot::default(),
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for Cohere {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        let mut stream = self.ask_stream(messages).await?;
+        let mut full_response = String::new();
+        while let Some(chunk_result) = stream.next().await {
+            let chunk = chunk_result?;
+            full_response.push_str(&chunk);
+        }
+        Ok(full_response)
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        let preamble: Vec<&str> = messages
+            .iter()
+            .filter(|msg| msg.role == "system")
+            .map(|msg| msg.content.as_str())
+            .collect();
+
+        let mut turns: Vec<&Message> = messages.iter().filter(|msg| msg.role != "system").collect();
+        let message = match turns.last() {
+            Some(msg) if msg.role == "user" => turns.pop().map(|msg| msg.content.clone()),
+            _ => None,
+        }
+        .unwrap_or_default();
+        let chat_history = turns
+            .into_iter()
+            .map(|msg| HistoryMessage {
+                role: if msg.role == "model" {
+                    "CHATBOT"
+                } else {
+                    "USER"
+                },
+                message: msg.content.clone(),
+            })
+            .collect();
+
+        let request_body = RequestBody {
+            model: self.model.clone(),
+            message,
+            chat_history,
+            preamble: (!preamble.is_empty()).then(|| preamble.join("\n\n")),
+            stream: true,
+        };
+
+        self.usage.clear();
+        let res = self
+            .http
+            .send(
+                self.http
+                    .post(URL)
+                    .bearer_auth(&self.api_key)
+                    .json(&request_body),
+            )
+            .await?;
+
+        if !res.status().is_success() {
+            let status = res.status();
+            let error_text = res.text().await?;
+            return Err(format!("API Error: {} - {}", status, error_text).into());
+        }
+
+        let mut byte_stream = res.bytes_stream();
+        let usage = self.usage.clone();
+
+        let stream = try_stream! {
+            let mut buffer = String::new();
+            let mut decoder = Utf8Decoder::default();
+            'outer: while let Some(chunk_result) = byte_stream.next().await {
+                let chunk = chunk_result?;
+                buffer.push_str(&decoder.decode(&chunk));
+
+                while let Some(newline_idx) = buffer.find('\n') {
+                    let line: String = buffer.drain(..=newline_idx).collect();
+                    let line = line.trim();
+                    if line.is_empty() { continue; }
+                    let event: Event = serde_json::from_str(line)?;
+                    match event.event_type.as_str() {
+                        "text-generation" => {
+                            if let Some(text) = event.text.filter(|t| !t.is_empty()) { yield text; }
+                        }
+                        "stream-end" => {
+                            if let Some(reason) = event.finish_reason.filter(|r| r == "ERROR" || r == "ERROR_TOXIC") {
+                                Err::<(), _>(format!("API Error: generation stopped ({})", reason))?;
+                            }
+                            if let Some(units) = event.response.and_then(|r| r.meta).and_then(|m| m.billed_units) {
+                                usage.set(TokenUsage { prompt: units.input_tokens as u32, completion: units.output_tokens as u32 });
+                            }
+                            break 'outer;
+                        }
+                        _ => {}
+                    }
+                }
+            }
+        };
+
+        Ok(Box::pin(stream))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.usage.get()
+    }
+}
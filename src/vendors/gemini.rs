@@ -1,28 +1,62 @@
-use super::{LanguageModel, Message, ResponseStream};
+use super::http::HttpClient;
+use super::{LanguageModel, Message, ResponseStream, TokenUsage, UsageSlot, Utf8Decoder};
 use async_stream::try_stream;
 use async_trait::async_trait;
+use base64::Engine;
+use base64::engine::general_purpose::STANDARD;
 use serde::{Deserialize, Serialize};
 use tokio_stream::StreamExt;
 
 // Request Structures
 #[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
 struct RequestBody {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    system_instruction: Option<RequestSystem>,
     contents: Vec<RequestContent>,
 }
 #[derive(Serialize)]
+struct RequestSystem {
+    parts: Vec<RequestPart>,
+}
+#[derive(Serialize)]
 struct RequestContent {
     role: String,
     parts: Vec<RequestPart>,
 }
 #[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
 struct RequestPart {
-    text: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    text: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    inline_data: Option<InlineData>,
+}
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct InlineData {
+    mime_type: String,
+    // base64
+    data: String,
+}
+
+impl RequestPart {
+    fn text(text: &str) -> Self {
+        Self {
+            text: Some(text.to_string()),
+            inline_data: None,
+        }
+    }
 }
 
 // Response Structures
 #[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
 struct ResponseBody {
+    #[serde(default)]
     candidates: Vec<ResponseCandidate>,
+    #[serde(default)]
+    usage_metadata: Option<UsageMetadata>,
 }
 #[derive(Deserialize)]
 struct ResponseCandidate {
@@ -36,17 +70,28 @@ struct ResponseContent {
 struct ResponsePart {
     text: String,
 }
+// running totals, repeated on every chunk
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct UsageMetadata {
+    #[serde(default)]
+    prompt_token_count: u32,
+    #[serde(default)]
+    candidates_token_count: u32,
+}
 
 pub struct Gemini {
     api_key: String,
-    client: reqwest::Client,
+    http: HttpClient,
+    usage: UsageSlot,
 }
 
 impl Gemini {
-    pub fn new(api_key: String) -> Self {
+    pub fn new(http: HttpClient, api_key: String) -> Self {
         Self {
             api_key,
-            client: reqwest::Client::new(),
+            http,
+            usage: UsageSlot::default(),
         }
     }
 }
@@ -78,21 +123,43 @@ impl LanguageModel for Gemini {
             &self.api_key
         );
 
+        let system_parts: Vec<RequestPart> = messages
+            .iter()
+            .filter(|msg| msg.role == "system")
+            .map(|msg| RequestPart::text(&msg.content))
+            .collect();
+
         let request_contents: Vec<RequestContent> = messages
             .iter()
-            .map(|msg| RequestContent {
-                role: msg.role.clone(),
-                parts: vec![RequestPart {
-                    text: msg.content.clone(),
-                }],
+            .filter(|msg| msg.role != "system")
+            .map(|msg| {
+                let mut parts = vec![RequestPart::text(&msg.content)];
+                parts.extend(msg.images.iter().map(|image| RequestPart {
+                    text: None,
+                    inline_data: Some(InlineData {
+                        mime_type: image.mime_type.clone(),
+                        data: STANDARD.encode(&image.data),
+                    }),
+                }));
+                RequestContent {
+                    role: msg.role.clone(),
+                    parts,
+                }
             })
             .collect();
 
         let request_body = RequestBody {
+            system_instruction: (!system_parts.is_empty()).then(|| RequestSystem {
+                parts: system_parts,
+            }),
             contents: request_contents,
         };
 
-        let res = self.client.post(&url).json(&request_body).send().await?;
+        self.usage.clear();
+        let res = self
+            .http
+            .send(self.http.post(&url).json(&request_body))
+            .await?;
 
         if !res.status().is_success() {
             let status = res.status();
@@ -101,12 +168,14 @@ impl LanguageModel for Gemini {
         }
 
         let mut byte_stream = res.bytes_stream();
+        let usage = self.usage.clone();
 
         let stream = try_stream! {
             let mut buffer = String::new();
+            let mut decoder = Utf8Decoder::default();
             while let Some(chunk_result) = byte_stream.next().await {
                 let chunk = chunk_result?;
-                buffer.push_str(&String::from_utf8_lossy(&chunk));
+                buffer.push_str(&decoder.decode(&chunk));
 
                 loop {
                     if let Some(start_idx) = buffer.find('{') {
@@ -125,6 +194,9 @@ impl LanguageModel for Gemini {
                         if let Some(end_idx) = end_idx_opt {
                             let object_str = &buffer[start_idx..end_idx];
                             if let Ok(rb) = serde_json::from_str::<ResponseBody>(object_str) {
+                                if let Some(um) = &rb.usage_metadata {
+                                    usage.set(TokenUsage { prompt: um.prompt_token_count, completion: um.candidates_token_count });
+                                }
                                 if let Some(text) = rb.candidates.first().and_then(|c| c.content.parts.first()).map(|p| p.text.clone()) {
                                     if !text.is_empty() { yield text; }
                                 }
@@ -138,4 +210,12 @@ impl LanguageModel for Gemini {
 
         Ok(Box::pin(stream))
     }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.usage.get()
+    }
+
+    fn supports_images(&self) -> bool {
+        true
+    }
 }
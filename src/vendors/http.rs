@@ -0,0 +1,93 @@
+use crate::logger::verbose;
+use crate::ui::info;
+use reqwest::{RequestBuilder, Response, StatusCode};
+use std::time::{Duration, Instant};
+
+pub const DEFAULT_MAX_RETRIES: u32 = 3;
+pub const DEFAULT_CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+// doubled after every failed attempt: 1s, 2s, 4s...
+const BASE_DELAY: Duration = Duration::from_secs(1);
+
+// one connection pool for every vendor, plus the retry policy
+#[derive(Clone)]
+pub struct HttpClient {
+    client: reqwest::Client,
+    max_retries: u32,
+}
+
+#[derive(Default)]
+pub struct HttpOptions {
+    pub max_retries: Option<u32>,
+    pub connect_timeout: Option<Duration>,
+    // without one, reqwest already honours HTTP_PROXY / HTTPS_PROXY
+    pub proxy: Option<String>,
+    pub skip_tls_verify: bool,
+}
+
+impl HttpClient {
+    pub fn new(options: &HttpOptions) -> Result<Self, reqwest::Error> {
+        let mut builder = reqwest::Client::builder()
+            .connect_timeout(options.connect_timeout.unwrap_or(DEFAULT_CONNECT_TIMEOUT))
+            .danger_accept_invalid_certs(options.skip_tls_verify);
+        if let Some(proxy) = &options.proxy {
+            builder = builder.proxy(reqwest::Proxy::all(proxy)?);
+        }
+        let client = builder.build()?;
+        Ok(Self {
+            client,
+            max_retries: options.max_retries.unwrap_or(DEFAULT_MAX_RETRIES),
+        })
+    }
+
+    pub fn post(&self, url: &str) -> RequestBuilder {
+        self.client.post(url)
+    }
+
+    // retries rate limits, server errors and timeouts; anything else (a bad
+    // key, a malformed request) is returned straight away for the caller
+    pub async fn send(&self, request: RequestBuilder) -> Result<Response, reqwest::Error> {
+        let mut retries = 0;
+        loop {
+            // bodies we send are plain json, so this only fails for streams
+            let Some(attempt) = request.try_clone() else {
+                return request.send().await;
+            };
+            let attempt = attempt.build()?;
+            // the query can hold an api key (gemini), so leave it out
+            let mut url = attempt.url().clone();
+            url.set_query(None);
+            let started = Instant::now();
+            let result = self.client.execute(attempt).await;
+            match &result {
+                Ok(res) => verbose!(
+                    "POST {} -> {} in {:?}",
+                    url,
+                    res.status(),
+                    started.elapsed()
+                ),
+                Err(e) => verbose!("POST {} failed after {:?}: {}", url, started.elapsed(), e),
+            }
+            let retryable = match &result {
+                Ok(res) => is_retryable(res.status()),
+                Err(e) => e.is_timeout() || e.is_connect(),
+            };
+            if !retryable || retries >= self.max_retries {
+                return result;
+            }
+            retries += 1;
+            info!("Retrying... (attempt {}/{})", retries, self.max_retries);
+            tokio::time::sleep(BASE_DELAY * 2u32.pow(retries - 1)).await;
+        }
+    }
+}
+
+fn is_retryable(status: StatusCode) -> bool {
+    matches!(
+        status,
+        StatusCode::TOO_MANY_REQUESTS
+            | StatusCode::INTERNAL_SERVER_ERROR
+            | StatusCode::BAD_GATEWAY
+            | StatusCode::SERVICE_UNAVAILABLE
+            | StatusCode::GATEWAY_TIMEOUT
+    )
+}
@@ -1,9 +1,17 @@
 use async_trait::async_trait;
 use serde::{Deserialize, Serialize};
 use std::pin::Pin;
+use std::sync::{Arc, Mutex};
 use tokio_stream::Stream;
 
+pub mod anthropic;
+pub mod azure;
+pub mod bedrock;
+pub mod cohere;
 pub mod gemini;
+pub mod http;
+pub mod ollama;
+pub mod openai;
 
 pub type StreamChunk = Result<String, Box<dyn std::error::Error + Send + Sync>>;
 pub type ResponseStream = Pin<Box<dyn Stream<Item = StreamChunk> + Send>>;
@@ -12,6 +20,82 @@ pub type ResponseStream = Pin<Box<dyn Stream<Item = StreamChunk> + Send>>;
 pub struct Message {
     pub role: String,
     pub content: String,
+    // sent alongside the text by vendors that take them (gemini)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub images: Vec<Image>,
+}
+
+#[derive(Serialize, Deserialize, Clone)]
+pub struct Image {
+    pub mime_type: String,
+    #[serde(skip)]
+    pub data: Vec<u8>,
+}
+
+#[derive(Debug, Clone, Copy, Default)]
+pub struct TokenUsage {
+    pub prompt: u32,
+    pub completion: u32,
+}
+
+impl TokenUsage {
+    pub fn total(&self) -> u32 {
+        self.prompt + self.completion
+    }
+}
+
+// written by a response stream as the vendor reports counts, read once it ends
+#[derive(Clone, Default)]
+pub struct UsageSlot(Arc<Mutex<Option<TokenUsage>>>);
+
+impl UsageSlot {
+    pub fn set(&self, usage: TokenUsage) {
+        *self.0.lock().unwrap() = Some(usage);
+    }
+
+    pub fn get(&self) -> Option<TokenUsage> {
+        *self.0.lock().unwrap()
+    }
+
+    pub fn clear(&self) {
+        *self.0.lock().unwrap() = None;
+    }
+}
+
+// a network chunk can end partway through a character. The start of it is
+// held back until the next chunk instead of being decoded as U+FFFD
+#[derive(Default)]
+pub struct Utf8Decoder {
+    pending: Vec<u8>,
+}
+
+impl Utf8Decoder {
+    pub fn decode(&mut self, chunk: &[u8]) -> String {
+        self.pending.extend_from_slice(chunk);
+        let complete = self.pending.len() - incomplete_tail(&self.pending);
+        let rest = self.pending.split_off(complete);
+        let text = String::from_utf8_lossy(&self.pending).into_owned();
+        self.pending = rest;
+        text
+    }
+}
+
+// how many bytes at the end start a character that hasn't all arrived
+fn incomplete_tail(bytes: &[u8]) -> usize {
+    for back in 1..=bytes.len().min(3) {
+        let byte = bytes[bytes.len() - back];
+        if byte & 0xC0 == 0x80 {
+            continue;
+        }
+        let needed = match byte {
+            0xC0..=0xDF => 2,
+            0xE0..=0xEF => 3,
+            0xF0..=0xF7 => 4,
+            _ => 1,
+        };
+        return if needed > back { back } else { 0 };
+    }
+    0
 }
 
 #[async_trait]
@@ -25,4 +109,67 @@ pub trait LanguageModel: Send + Sync {
         &self,
         messages: &[Message],
     ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>>;
+
+    // token counts for the last response, once its stream has finished;
+    // None when the vendor doesn't report them
+    fn last_usage(&self) -> Option<TokenUsage> {
+        None
+    }
+
+    // whether Message::images reach the model; callers refuse to send
+    // images to one that would drop them
+    fn supports_images(&self) -> bool {
+        false
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn utf8_decoder_splits() {
+        let cases = [
+            "plain ascii",
+            "héllo wörld",
+            "price: 5€",
+            "🦀 ok 🦀",
+            "日本語のテキスト",
+        ];
+        for text in cases {
+            let bytes = text.as_bytes();
+            for cut in 0..=bytes.len() {
+                let mut decoder = Utf8Decoder::default();
+                let mut got = decoder.decode(&bytes[..cut]);
+                got.push_str(&decoder.decode(&bytes[cut..]));
+                assert_eq!(got, text, "cut at byte {}", cut);
+            }
+        }
+    }
+
+    #[test]
+    fn utf8_decoder_one_byte_at_a_time() {
+        let text = "a€b🦀c";
+        let mut decoder = Utf8Decoder::default();
+        let got: String = text
+            .as_bytes()
+            .iter()
+            .map(|b| decoder.decode(std::slice::from_ref(b)))
+            .collect();
+        assert_eq!(got, text);
+    }
+
+    #[test]
+    fn utf8_decoder_invalid_bytes() {
+        let cases: [(&[u8], &str); 3] = [
+            (b"ok\xffok", "ok\u{FFFD}ok"),
+            // a stray continuation byte isn't held back
+            (b"ok\x80", "ok\u{FFFD}"),
+            // an unfinished character is, until more arrives
+            (b"ok\xe2\x82", "ok"),
+        ];
+        for (bytes, want) in cases {
+            assert_eq!(Utf8Decoder::default().decode(bytes), want, "{:?}", bytes);
+        }
+    }
 }
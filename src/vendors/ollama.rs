@@ -0,0 +1,153 @@
+use super::http::HttpClient;
+use super::{LanguageModel, Message, ResponseStream, TokenUsage, UsageSlot, Utf8Decoder};
+use async_stream::try_stream;
+use async_trait::async_trait;
+use serde::{Deserialize, Serialize};
+use tokio_stream::StreamExt;
+
+const DEFAULT_BASE_URL: &str = "http://localhost:11434";
+
+// Request Structures
+#[derive(Serialize)]
+struct RequestBody {
+    model: String,
+    messages: Vec<RequestMessage>,
+    stream: bool,
+}
+#[derive(Serialize)]
+struct RequestMessage {
+    role: String,
+    content: String,
+}
+
+// Response Structures (one JSON object per line)
+#[derive(Deserialize)]
+struct ChunkBody {
+    #[serde(default)]
+    message: Option<ChunkMessage>,
+    #[serde(default)]
+    done: bool,
+    #[serde(default)]
+    error: Option<String>,
+    // only set on the final (done) chunk
+    #[serde(default)]
+    prompt_eval_count: Option<u32>,
+    #[serde(default)]
+    eval_count: Option<u32>,
+}
+#[derive(Deserialize)]
+struct ChunkMessage {
+    content: String,
+}
+
+pub struct Ollama {
+    base_url: String,
+    model: String,
+    http: HttpClient,
+    usage: UsageSlot,
+}
+
+impl Ollama {
+    // accepts "ollama:<model>" or a bare model name like "library/llama3.2"
+    pub fn new(http: HttpClient, base_url: Option<&str>, model: &str) -> Self {
+        Self {
+            base_url: base_url
+                .unwrap_or(DEFAULT_BASE_URL)
+                .trim_end_matches('/')
+                .to_string(),
+            model: model.strip_prefix("ollama:").unwrap_or(model).to_string(),
+            http,
+            usage: UsageSlot::default(),
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for Ollama {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        let mut stream = self.ask_stream(messages).await?;
+        let mut full_response = String::new();
+        while let Some(chunk_result) = stream.next().await {
+            let chunk = chunk_result?;
+            full_response.push_str(&chunk);
+        }
+        Ok(full_response)
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        let url = format!("{}/api/chat", self.base_url);
+
+        let request_messages: Vec<RequestMessage> = messages
+            .iter()
+            .map(|msg| RequestMessage {
+                role: match msg.role.as_str() {
+                    "model" => "assistant".to_string(),
+                    role => role.to_string(),
+                },
+                content: msg.content.clone(),
+            })
+            .collect();
+
+        let request_body = RequestBody {
+            model: self.model.clone(),
+            messages: request_messages,
+            stream: true,
+        };
+
+        self.usage.clear();
+        let res = self
+            .http
+            .send(self.http.post(&url).json(&request_body))
+            .await?;
+
+        if !res.status().is_success() {
+            let status = res.status();
+            let error_text = res.text().await?;
+            return Err(format!("API Error: {} - {}", status, error_text).into());
+        }
+
+        let mut byte_stream = res.bytes_stream();
+        let usage = self.usage.clone();
+
+        let stream = try_stream! {
+            let mut buffer = String::new();
+            let mut decoder = Utf8Decoder::default();
+            'outer: while let Some(chunk_result) = byte_stream.next().await {
+                let chunk = chunk_result?;
+                buffer.push_str(&decoder.decode(&chunk));
+
+                while let Some(newline_idx) = buffer.find('\n') {
+                    let line: String = buffer.drain(..=newline_idx).collect();
+                    let line = line.trim();
+                    if line.is_empty() { continue; }
+                    let cb: ChunkBody = serde_json::from_str(line)?;
+                    if let Some(error) = cb.error {
+                        Err::<(), _>(format!("API Error: {}", error))?;
+                    }
+                    if let Some(message) = cb.message {
+                        if !message.content.is_empty() { yield message.content; }
+                    }
+                    if cb.done {
+                        usage.set(TokenUsage {
+                            prompt: cb.prompt_eval_count.unwrap_or(0),
+                            completion: cb.eval_count.unwrap_or(0),
+                        });
+                        break 'outer;
+                    }
+                }
+            }
+        };
+
+        Ok(Box::pin(stream))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.usage.get()
+    }
+}
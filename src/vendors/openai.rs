@@ -0,0 +1,185 @@
+use super::http::HttpClient;
+use super::{LanguageModel, Message, ResponseStream, TokenUsage, UsageSlot, Utf8Decoder};
+use async_stream::try_stream;
+use async_trait::async_trait;
+use serde::{Deserialize, Serialize};
+use tokio_stream::StreamExt;
+
+const DEFAULT_MODEL: &str = "gpt-4o";
+const BASE_URL: &str = "https://api.openai.com/v1";
+
+// Request Structures
+#[derive(Serialize)]
+pub(super) struct RequestBody {
+    pub model: String,
+    pub messages: Vec<RequestMessage>,
+    pub stream: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub stream_options: Option<StreamOptions>,
+}
+// asks for a final chunk carrying the token counts
+#[derive(Serialize)]
+pub(super) struct StreamOptions {
+    pub include_usage: bool,
+}
+#[derive(Serialize)]
+pub(super) struct RequestMessage {
+    role: String,
+    content: String,
+}
+
+// Response Structures (streamed chunks)
+#[derive(Deserialize)]
+struct ChunkBody {
+    #[serde(default)]
+    choices: Vec<ChunkChoice>,
+    #[serde(default)]
+    usage: Option<ChunkUsage>,
+}
+#[derive(Deserialize)]
+struct ChunkChoice {
+    delta: ChunkDelta,
+}
+#[derive(Deserialize)]
+struct ChunkDelta {
+    #[serde(default)]
+    content: Option<String>,
+}
+#[derive(Deserialize)]
+struct ChunkUsage {
+    prompt_tokens: u32,
+    completion_tokens: u32,
+}
+
+pub struct OpenAi {
+    api_key: String,
+    model: String,
+    base_url: String,
+    // not every compatible vendor accepts stream_options
+    stream_usage: bool,
+    http: HttpClient,
+    usage: UsageSlot,
+}
+
+impl OpenAi {
+    // accepts "openai", "openai:<model>" or a bare model name like "gpt-4o"
+    pub fn new(http: HttpClient, api_key: String, model: &str) -> Self {
+        let model = match model {
+            "openai" => DEFAULT_MODEL,
+            m => m.strip_prefix("openai:").unwrap_or(m),
+        };
+        Self {
+            stream_usage: true,
+            ..Self::with_base_url(http, api_key, model, BASE_URL)
+        }
+    }
+
+    // for vendors that speak the same chat-completions protocol
+    pub fn with_base_url(http: HttpClient, api_key: String, model: &str, base_url: &str) -> Self {
+        Self {
+            api_key,
+            model: model.to_string(),
+            base_url: base_url.trim_end_matches('/').to_string(),
+            stream_usage: false,
+            http,
+            usage: UsageSlot::default(),
+        }
+    }
+}
+
+#[async_trait]
+impl LanguageModel for OpenAi {
+    async fn ask(
+        &self,
+        messages: &[Message],
+    ) -> Result<String, Box<dyn std::error::Error + Send + Sync>> {
+        let mut stream = self.ask_stream(messages).await?;
+        let mut full_response = String::new();
+        while let Some(chunk_result) = stream.next().await {
+            let chunk = chunk_result?;
+            full_response.push_str(&chunk);
+        }
+        Ok(full_response)
+    }
+
+    async fn ask_stream(
+        &self,
+        messages: &[Message],
+    ) -> Result<ResponseStream, Box<dyn std::error::Error + Send + Sync>> {
+        let url = format!("{}/chat/completions", self.base_url);
+
+        let request_body = RequestBody {
+            model: self.model.clone(),
+            messages: request_messages(messages),
+            stream: true,
+            stream_options: self.stream_usage.then_some(StreamOptions {
+                include_usage: true,
+            }),
+        };
+
+        self.usage.clear();
+        let mut request = self.http.post(&url).json(&request_body);
+        // local servers often take no key at all
+        if !self.api_key.is_empty() {
+            request = request.bearer_auth(&self.api_key);
+        }
+        let res = self.http.send(request).await?;
+
+        if !res.status().is_success() {
+            let status = res.status();
+            let error_text = res.text().await?;
+            return Err(format!("API Error: {} - {}", status, error_text).into());
+        }
+
+        Ok(chunk_stream(res, self.usage.clone()))
+    }
+
+    fn last_usage(&self) -> Option<TokenUsage> {
+        self.usage.get()
+    }
+}
+
+pub(super) fn request_messages(messages: &[Message]) -> Vec<RequestMessage> {
+    messages
+        .iter()
+        .map(|msg| RequestMessage {
+            // gemini calls the assistant "model"
+            role: match msg.role.as_str() {
+                "model" => "assistant".to_string(),
+                role => role.to_string(),
+            },
+            content: msg.content.clone(),
+        })
+        .collect()
+}
+
+// server-sent events, one `data: {...}` line per chunk
+pub(super) fn chunk_stream(res: reqwest::Response, usage: UsageSlot) -> ResponseStream {
+    let mut byte_stream = res.bytes_stream();
+
+    let stream = try_stream! {
+        let mut buffer = String::new();
+        let mut decoder = Utf8Decoder::default();
+        'outer: while let Some(chunk_result) = byte_stream.next().await {
+            let chunk = chunk_result?;
+            buffer.push_str(&decoder.decode(&chunk));
+
+            while let Some(newline_idx) = buffer.find('\n') {
+                let line: String = buffer.drain(..=newline_idx).collect();
+                let Some(data) = line.trim().strip_prefix("data:") else { continue; };
+                let data = data.trim();
+                if data == "[DONE]" { break 'outer; }
+                if let Ok(cb) = serde_json::from_str::<ChunkBody>(data) {
+                    if let Some(u) = &cb.usage {
+                        usage.set(TokenUsage { prompt: u.prompt_tokens, completion: u.completion_tokens });
+                    }
+                    if let Some(text) = cb.choices.first().and_then(|c| c.delta.content.clone()) {
+                        if !text.is_empty() { yield text; }
+                    }
+                }
+            }
+        }
+    };
+
+    Box::pin(stream)
+}
@@ -0,0 +1,10 @@
+// shown by `aiterm --version`; the commit and date come from build.rs
+pub const LONG: &str = concat!(
+    env!("CARGO_PKG_VERSION"),
+    "\ncommit: ",
+    env!("AITERM_COMMIT"),
+    "\nbuilt: ",
+    env!("AITERM_BUILD_DATE"),
+    // what the built-in personas use (see persona.rs and vendors/gemini.rs)
+    "\ndefault model: gemini (gemini-1.5-flash)"
+);
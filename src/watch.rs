@@ -0,0 +1,69 @@
+// `aiterm watch`: what changed between two runs of a command
+pub const DEFAULT_INTERVAL_SECS: u64 = 5;
+
+// removed lines as "- ", added as "+ ", unchanged ones left out; empty when
+// nothing changed
+pub fn diff_lines(old: &str, new: &str) -> String {
+    let old: Vec<&str> = old.lines().collect();
+    let new: Vec<&str> = new.lines().collect();
+
+    // lcs[i][j]: longest common run of old[i..] and new[j..]
+    let mut lcs = vec![vec![0usize; new.len() + 1]; old.len() + 1];
+    for i in (0..old.len()).rev() {
+        for j in (0..new.len()).rev() {
+            lcs[i][j] = if old[i] == new[j] {
+                lcs[i + 1][j + 1] + 1
+            } else {
+                lcs[i + 1][j].max(lcs[i][j + 1])
+            };
+        }
+    }
+
+    let mut out = String::new();
+    let (mut i, mut j) = (0, 0);
+    while i < old.len() || j < new.len() {
+        if i < old.len() && j < new.len() && old[i] == new[j] {
+            i += 1;
+            j += 1;
+        } else if i < old.len() && (j == new.len() || lcs[i + 1][j] >= lcs[i][j + 1]) {
+            out.push_str(&format!("- {}\n", old[i]));
+            i += 1;
+        } else {
+            out.push_str(&format!("+ {}\n", new[j]));
+            j += 1;
+        }
+    }
+    out
+}
+
+pub fn change_prompt(command: &str, diff: &str) -> String {
+    format!(
+        "The output of `{}` changed:\n```diff\n{}```\nWhat should I do?",
+        command, diff
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn diff_lines_cases() {
+        let cases = [
+            ("", "", ""),
+            ("a\nb\n", "a\nb\n", ""),
+            ("a\n", "a\nb\n", "+ b\n"),
+            ("a\nb\n", "b\n", "- a\n"),
+            ("a\nb\nc\n", "a\nx\nc\n", "- b\n+ x\n"),
+            ("", "up\n", "+ up\n"),
+            ("down\n", "", "- down\n"),
+            // a moved line shows as removed here, added there
+            ("a\nb\nc\n", "b\nc\na\n", "- a\n+ a\n"),
+            // a missing final newline is no change
+            ("a\nb", "a\nb\n", ""),
+        ];
+        for (old, new, want) in cases {
+            assert_eq!(diff_lines(old, new), want, "{:?} -> {:?}", old, new);
+        }
+    }
+}